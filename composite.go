@@ -0,0 +1,50 @@
+package effects
+
+// Sequence is a command that runs its commands in order with DoSeries,
+// stopping at the first error.  Its commands are cmd pointers, which may
+// themselves be Sequences or Parallels, e.g.
+//
+//	ctx.Do(&effects.Sequence{&Now{}, &effects.Parallel{&Get{}, &Get{}}})
+type Sequence []interface{}
+
+func (s *Sequence) Do(ctx Context) error {
+	return ctx.DoSeries([]interface{}(*s))
+}
+
+// Parallel is a command that runs its commands concurrently with
+// DoConcurrent.
+type Parallel []interface{}
+
+func (p *Parallel) Do(ctx Context) error {
+	return ctx.DoConcurrent([]interface{}(*p))
+}
+
+// Walk calls fn for cmd and, if cmd is a Sequence or Parallel, for every
+// command nested within it, depth first.  depth is 0 for cmd.  Walk stops at
+// the first error returned by fn.
+func Walk(cmd interface{}, fn func(cmd interface{}, depth int) error) error {
+	return walk(cmd, 0, fn)
+}
+
+func walk(cmd interface{}, depth int, fn func(interface{}, int) error) error {
+	err := fn(cmd, depth)
+	if err != nil {
+		return err
+	}
+
+	var children []interface{}
+	switch c := cmd.(type) {
+	case *Sequence:
+		children = *c
+	case *Parallel:
+		children = *c
+	}
+
+	for _, child := range children {
+		err := walk(child, depth+1, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
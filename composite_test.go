@@ -0,0 +1,187 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEffectsSequenceAndParallel(t *testing.T) {
+	mu := sync.Mutex{}
+	var seen []string
+	ctx := effects.NewContext(context.Background(), func(ctx effects.Context, command interface{}) error {
+		switch cmd := command.(type) {
+		case *Get:
+			mu.Lock()
+			seen = append(seen, cmd.URL)
+			mu.Unlock()
+			cmd.Body = "body of " + cmd.URL
+			return nil
+		}
+		return interpreter(ctx, command)
+	})
+
+	n := Now{}
+	a := Get{URL: "/a"}
+	b := Get{URL: "/b"}
+	c := Get{URL: "/c"}
+	program := effects.Sequence{
+		&n,
+		&effects.Parallel{&a, &b},
+		&effects.Sequence{&c},
+	}
+
+	err := ctx.Do(&program)
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+	assert.Equal(t, "body of /a", a.Body)
+	assert.Equal(t, "body of /b", b.Body)
+	assert.Equal(t, "body of /c", c.Body)
+	assert.Equal(t, 3, len(seen))
+	assert.Equal(t, "/c", seen[2])
+}
+
+func TestEffectsSequenceStopsAtFirstError(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	n := Now{}
+	err := ctx.Do(&effects.Sequence{&effects.Parallel{&Now{}, &ErrorOut{}}, &n})
+	assert.Equal(t, "oops", err.Error())
+	assert.Equal(t, time.Time{}, n.Time)
+}
+
+func TestEffectsWalk(t *testing.T) {
+	program := &effects.Sequence{
+		&Now{},
+		&effects.Parallel{&Get{URL: "/a"}, &Get{URL: "/b"}},
+	}
+
+	var visited []string
+	err := effects.Walk(program, func(cmd interface{}, depth int) error {
+		visited = append(visited, fmt.Sprintf("%d %T", depth, cmd))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"0 *effects.Sequence",
+		"1 *effects_test.Now",
+		"1 *effects.Parallel",
+		"2 *effects_test.Get",
+		"2 *effects_test.Get",
+	}, visited)
+}
+
+func TestEffectsRegistryMarshalComposite(t *testing.T) {
+	registry := newRegistry()
+
+	program := &effects.Sequence{
+		&Get{URL: "/a"},
+		&effects.Parallel{&Get{URL: "/b"}, &Now{}},
+	}
+
+	data, err := registry.Marshal(program)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"type":"effects.Sequence","payload":[
+		{"type":"effects_test.Get","payload":{"URL":"/a","Body":""}},
+		{"type":"effects.Parallel","payload":[
+			{"type":"effects_test.Get","payload":{"URL":"/b","Body":""}},
+			{"type":"effects_test.Now","payload":{"Time":"0001-01-01T00:00:00Z"}}
+		]}
+	]}`, string(data))
+
+	cmd, err := registry.Unmarshal(data)
+	assert.Nil(t, err)
+	assert.Equal(t, program, cmd)
+
+	err = registry.Register("effects.Sequence", &Panic{})
+	assert.Equal(t, "`effects.Sequence` is not a valid name for *effects_test.Panic", err.Error())
+}
+
+// FetchProfile is a Callable that issues a Get and then a Now.
+type FetchProfile struct {
+	ID      string
+	Body    string
+	Fetched time.Time
+}
+
+func (p *FetchProfile) Do(ctx effects.Context) error {
+	g := Get{URL: "/people/" + p.ID}
+	err := ctx.Do(&g)
+	if err != nil {
+		return err
+	}
+
+	n := Now{}
+	err = ctx.Do(&n)
+	p.Body = g.Body
+	p.Fetched = n.Time
+	return err
+}
+
+func TestEffectsTestContextRunsCallables(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.RunCallables(), effects.ExpandBatches())
+
+	ctx.Expect(&Now{}).Returns(Now{Time: now})
+	ctx.InAnyOrder(func() {
+		ctx.Expect(&Get{URL: "/people/1"}).Returns(Get{Body: "luke"})
+		ctx.Expect(&Get{URL: "/people/2"}).Returns(Get{Body: "leia"})
+		ctx.Expect(&Now{}).Returns(Now{Time: later}).Times(2)
+	})
+
+	first := FetchProfile{ID: "1"}
+	second := FetchProfile{ID: "2"}
+	n := Now{}
+	err := ctx.Do(&effects.Sequence{&n, &effects.Sequence{&first, &second}})
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+	assert.Equal(t, "luke", first.Body)
+	assert.Equal(t, "leia", second.Body)
+	assert.Equal(t, later, second.Fetched)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestContextStubsMatchingCallables(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.RunCallables())
+
+	ctx.Expect(&FetchProfile{ID: "1"}).Returns(FetchProfile{Body: "stubbed"})
+	ctx.Expect(&Get{URL: "/people/2"}).Fails(errors.New("not found"))
+
+	first := FetchProfile{ID: "1"}
+	assert.Nil(t, ctx.Do(&first))
+	assert.Equal(t, "stubbed", first.Body)
+
+	second := FetchProfile{ID: "2"}
+	assert.Equal(t, "not found", ctx.Do(&second).Error())
+
+	log := ctx.Log()
+	assert.Equal(t, 3, len(log))
+	assert.True(t, log[0].Stubbed())
+	assert.True(t, log[1].Stubbed())
+	assert.False(t, log[2].Stubbed())
+	assert.Equal(t, &second, log[2].Cmd)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestContextReportsMismatchedCallables(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t, effects.RunCallables())
+		ctx.Expect(&FetchProfile{ID: "1"}).Returns(FetchProfile{Body: "stubbed"})
+
+		ctx.Do(&FetchProfile{ID: "2"})
+	})
+	assert.Contains(t, output, `ID: expected "1", got "2"`)
+
+	output = expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t, effects.RunCallables(), effects.ExpandBatches())
+		ctx.Expect(&FetchProfile{ID: "1"}).Returns(FetchProfile{Body: "stubbed"})
+
+		ctx.DoConcurrent([]*FetchProfile{{ID: "2"}})
+	})
+	assert.Contains(t, output, "command number 1 in your function does not match any of the expectations that may be processed in any order")
+	assert.NotContains(t, output, "*effects_test.Get")
+}
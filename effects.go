@@ -9,6 +9,8 @@ import (
 	"time"
 )
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
 type Callable interface {
 	Do(Context) error
 }
@@ -17,6 +19,11 @@ type Context interface {
 	Do(interface{}) error
 	DoSeries(interface{}) error
 	DoConcurrent(interface{}) error
+	DoAsync(interface{}) Future
+	DoStream(interface{}) (Stream, error)
+	DoRace(interface{}) (int, error)
+	DoQuorum(interface{}, int) ([]error, error)
+	Enqueue(interface{}, EnqueueOptions) error
 	Deadline() (deadline time.Time, ok bool)
 	Done() <-chan struct{}
 	Err() error
@@ -26,8 +33,26 @@ type Context interface {
 type RealContext struct {
 	Context     context.Context
 	Interpreter func(Context, interface{}) error
+	Policy      *Policy
+	Middleware  []Middleware
+
+	// Queue and Registry are used by Enqueue.
+	Queue    JobQueue
+	Registry *TypeRegistry
+
+	// StreamInterpreter runs the commands passed to DoStream that do not
+	// implement Streamer.
+	StreamInterpreter func(ctx Context, cmd interface{}, emit func(interface{}) error) error
+
+	// dispatch, when set by WithHandler, runs commands in place of interpret.
+	dispatch func(Context, interface{}) error
 }
 
+// Middleware wraps the dispatch of commands to the interpreter (or to their
+// own Do method for Callable commands).  The first Middleware of a
+// RealContext is the outermost.
+type Middleware func(next func(Context, interface{}) error) func(Context, interface{}) error
+
 type InterpreterError struct {
 	Cmd   interface{}
 	Cause error
@@ -41,62 +66,100 @@ func InterpretSafely(ctx RealContext, cmd interface{}) (err error) {
 	defer func() {
 		r := recover()
 		if r != nil {
-			switch rec := r.(type) {
-			case error:
-				err = InterpreterError{
-					Cause: rec,
-					Cmd:   cmd,
-				}
-
-			case string:
-				err = InterpreterError{
-					Cause: errors.New(rec),
-					Cmd:   cmd,
-				}
-
-			default:
-				err = InterpreterError{
-					Cause: errors.New(fmt.Sprintf("%v", r)),
-					Cmd:   cmd,
-				}
-			}
+			err = recoveredError(r, cmd)
 		}
 	}()
+	dispatch := ctx.dispatch
+	if dispatch == nil {
+		dispatch = ctx.interpret
+	}
+	for i := len(ctx.Middleware) - 1; i >= 0; i-- {
+		dispatch = ctx.Middleware[i](dispatch)
+	}
+	err = dispatch(ctx, cmd)
+	return
+}
+
+// interpret runs cmd with its own Do method if it is Callable, or with the
+// interpreter otherwise.
+func (ctx RealContext) interpret(c Context, cmd interface{}) error {
 	callable, ok := cmd.(Callable)
 	if ok {
-		err = callable.Do(ctx)
-	} else {
-		err = ctx.Interpreter(ctx, cmd)
+		return callable.Do(c)
 	}
-	return
+	return ctx.Interpreter(c, cmd)
 }
 
-func (ctx RealContext) Do(cmd interface{}) error {
-	value := reflect.ValueOf(cmd)
-	if value.Kind() != reflect.Ptr {
-		return errors.New("ctx.Do(...) must receive a ptr")
+func recoveredError(r interface{}, cmd interface{}) error {
+	switch rec := r.(type) {
+	case error:
+		return InterpreterError{
+			Cause: rec,
+			Cmd:   cmd,
+		}
+
+	case string:
+		return InterpreterError{
+			Cause: errors.New(rec),
+			Cmd:   cmd,
+		}
+
+	default:
+		return InterpreterError{
+			Cause: errors.New(fmt.Sprintf("%v", r)),
+			Cmd:   cmd,
+		}
 	}
+}
 
-	if reflect.ValueOf(cmd).IsNil() {
-		return errors.New("ctx.Do(...) cannot receive a nil ptr")
+func (ctx RealContext) Do(cmd interface{}) error {
+	err := ctx.prepare("Do", cmd)
+	if err != nil {
+		return err
 	}
+
 	return InterpretSafely(ctx, cmd)
 }
 
-func (ctx RealContext) DoSeries(cmds interface{}) error {
-	s := reflect.ValueOf(cmds)
+// prepare checks that cmd may be dispatched by the method called name.  Like
+// InterpretSafely, it returns panics raised by Validate methods and policy
+// rules as an InterpreterError.
+func (ctx RealContext) prepare(name string, cmd interface{}) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = recoveredError(r, cmd)
+		}
+	}()
 
-	if s.Kind() != reflect.Slice {
-		return fmt.Errorf("a slice of cmd pointers must be passed to `DoSeries` but a `%v` was passed instead", s.Kind())
+	value := reflect.ValueOf(cmd)
+	if value.Kind() != reflect.Ptr {
+		return fmt.Errorf("ctx.%s(...) must receive a ptr", name)
 	}
 
-	list := make([]interface{}, s.Len())
+	if value.IsNil() {
+		return fmt.Errorf("ctx.%s(...) cannot receive a nil ptr", name)
+	}
 
-	for i := 0; i < s.Len(); i++ {
-		if s.Index(i).Kind() != reflect.Ptr {
-			return fmt.Errorf("a slice of ptrs must be passed to `DoSeries` but the slice contains a `%v` at index %d", s.Index(i).Kind(), i)
+	err = Validate(cmd)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Policy != nil {
+		err = ctx.Policy.Authorize(ctx, cmd)
+		if err != nil {
+			return err
 		}
-		list[i] = s.Index(i).Interface()
+	}
+
+	return nil
+}
+
+func (ctx RealContext) DoSeries(cmds interface{}) error {
+	list, err := cmdList("DoSeries", cmds)
+	if err != nil {
+		return err
 	}
 
 	for _, cmd := range list {
@@ -109,33 +172,24 @@ func (ctx RealContext) DoSeries(cmds interface{}) error {
 }
 
 func (ctx RealContext) DoConcurrent(cmds interface{}) error {
-	s := reflect.ValueOf(cmds)
-
-	if s.Kind() != reflect.Slice {
-		return fmt.Errorf("a slice of cmd pointers must be passed to `DoConcurrent` but a `%v` was passed instead", s.Kind())
-	}
-
-	list := make([]interface{}, s.Len())
-
-	for i := 0; i < s.Len(); i++ {
-		if s.Index(i).Kind() != reflect.Ptr {
-			return fmt.Errorf("a slice of ptrs must be passed to `DoConcurrent` but the slice contains a `%v` at index %d", s.Index(i).Kind(), i)
-		}
-		list[i] = s.Index(i).Interface()
+	list, err := cmdList("DoConcurrent", cmds)
+	if err != nil {
+		return err
 	}
 
+	mu := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	wg.Add(len(list))
 
-	var err error
-
 	for _, cmd := range list {
 		go func(c interface{}) {
 			defer wg.Done()
 
 			cmdErr := ctx.Do(c)
 			if cmdErr != nil {
+				mu.Lock()
 				err = cmdErr
+				mu.Unlock()
 			}
 		}(cmd)
 	}
@@ -144,6 +198,34 @@ func (ctx RealContext) DoConcurrent(cmds interface{}) error {
 	return err
 }
 
+// cmdList converts cmds, a slice of cmd pointers or of interfaces holding cmd
+// pointers passed to the method called name, to a list of commands.
+func cmdList(name string, cmds interface{}) ([]interface{}, error) {
+	s := reflect.ValueOf(cmds)
+
+	if s.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("a slice of cmd pointers must be passed to `%s` but a `%v` was passed instead", name, s.Kind())
+	}
+
+	list := make([]interface{}, s.Len())
+
+	for i := 0; i < s.Len(); i++ {
+		elem := s.Index(i)
+
+		// Slices of interfaces may hold commands of different types
+		if elem.Kind() == reflect.Interface {
+			elem = elem.Elem()
+		}
+
+		if elem.Kind() != reflect.Ptr {
+			return nil, fmt.Errorf("a slice of ptrs must be passed to `%s` but the slice contains a `%v` at index %d", name, elem.Kind(), i)
+		}
+		list[i] = elem.Interface()
+	}
+
+	return list, nil
+}
+
 func (ctx RealContext) Deadline() (deadline time.Time, ok bool) {
 	return ctx.Context.Deadline()
 }
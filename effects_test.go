@@ -203,6 +203,16 @@ func TestEffectsConcurrent(t *testing.T) {
 	assert.Equal(t, []*Now{{Time: now}, {Time: now}}, result)
 }
 
+func TestEffectsConcurrentErrors(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	err := ctx.DoConcurrent([]*ErrorOut{{}, {}, {}, {}, {}})
+	assert.Equal(t, "oops", err.Error())
+
+	err = ctx.Do(&effects.Parallel{&ErrorOut{}, &Now{}, &ErrorOut{}})
+	assert.Equal(t, "oops", err.Error())
+}
+
 func TestEffectsPassPointerToSliceToDoConcurrent(t *testing.T) {
 	fn := func(ctx effects.Context) error {
 		n := []*Now{{}, {}}
@@ -284,7 +294,8 @@ func TestEffectsUseParentContext(t *testing.T) {
 
 	done := make(chan struct{})
 
-	timeoutCtx, _ := context.WithTimeout(context.Background(), time.Millisecond*100)
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
 	ctx := effects.NewContext(timeoutCtx, interpreter)
 
 	go func() {
@@ -305,3 +316,69 @@ func TestEffectsUseParentContext(t *testing.T) {
 
 	<-done
 }
+
+func TestEffectsSeriesMixedTypes(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), func(ctx effects.Context, command interface{}) error {
+		switch cmd := command.(type) {
+		case *Get:
+			cmd.Body = "{...}"
+			return nil
+		}
+		return interpreter(ctx, command)
+	})
+
+	n := Now{}
+	g := Get{}
+	err := ctx.DoSeries([]interface{}{&n, &g})
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+	assert.Equal(t, "{...}", g.Body)
+
+	n = Now{}
+	g = Get{}
+	err = ctx.DoConcurrent([]interface{}{&n, &g})
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+	assert.Equal(t, "{...}", g.Body)
+}
+
+func TestEffectsPassMixedSliceOfNonPtrs(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	err := ctx.DoSeries([]interface{}{&Now{}, Now{}})
+	assert.NotNil(t, err)
+	assert.Equal(t, "a slice of ptrs must be passed to `DoSeries` but the slice contains a `struct` at index 1", err.Error())
+
+	err = ctx.DoConcurrent([]interface{}{nil})
+	assert.NotNil(t, err)
+	assert.Equal(t, "a slice of ptrs must be passed to `DoConcurrent` but the slice contains a `invalid` at index 0", err.Error())
+}
+
+func TestEffectsMiddleware(t *testing.T) {
+	var calls []string
+	middleware := func(name string) effects.Middleware {
+		return func(next func(effects.Context, interface{}) error) func(effects.Context, interface{}) error {
+			return func(ctx effects.Context, cmd interface{}) error {
+				calls = append(calls, fmt.Sprintf("%s %T", name, cmd))
+				return next(ctx, cmd)
+			}
+		}
+	}
+
+	ctx := effects.RealContext{
+		Context:     context.Background(),
+		Interpreter: interpreter,
+		Middleware:  []effects.Middleware{middleware("outer"), middleware("inner")},
+	}
+
+	n := Now{}
+	err := ctx.Do(&effects.Sequence{&n})
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+	assert.Equal(t, []string{
+		"outer *effects.Sequence",
+		"inner *effects.Sequence",
+		"outer *effects_test.Now",
+		"inner *effects_test.Now",
+	}, calls)
+}
@@ -2,12 +2,37 @@ package effects_test
 
 import (
 	"errors"
+	"fmt"
 	"github.com/orourkedd/effects"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
 
+const expectFatalEnv = "EFFECTS_EXPECT_FATAL"
+
+// expectFatal runs fn in a subprocess of the test binary so that a harness
+// failure reported through t can be asserted on.  It returns the
+// subprocess output.
+func expectFatal(t *testing.T, fn func(t *testing.T)) string {
+	if os.Getenv(expectFatalEnv) == t.Name() {
+		fn(t)
+		return ""
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), expectFatalEnv+"="+t.Name())
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected the test harness to fail the test, but it passed:\n%s", output)
+	}
+	return string(output)
+}
+
 type Get struct {
 	URL  string
 	Body string
@@ -48,7 +73,7 @@ func testRunnerFn(ctx effects.Context) (string, error) {
 }
 
 func TestEffectsTestRunner(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t)
 
 	ctx.Cmd(func(cmd *Now) {
 		assert.Equal(t, cmd, &Now{})
@@ -79,11 +104,11 @@ func TestEffectsTestRunner(t *testing.T) {
 	body, err := testRunnerFn(ctx)
 	assert.Nil(t, err)
 	assert.Equal(t, "{...}", body)
-	assert.Nil(t, ctx.Finished())
+	ctx.Finished(t)
 }
 
 func TestEffectsTestRunnerErrorSingle(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t)
 
 	ctx.Cmd(func(cmd *Now) error {
 		assert.Equal(t, cmd, &Now{})
@@ -93,11 +118,11 @@ func TestEffectsTestRunnerErrorSingle(t *testing.T) {
 	body, err := testRunnerFn(ctx)
 	assert.Equal(t, err.Error(), "oops")
 	assert.Equal(t, "", body)
-	assert.Nil(t, ctx.Finished())
+	ctx.Finished(t)
 }
 
 func TestEffectsTestRunnerErrorSingleTwoDeep(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t)
 
 	ctx.Cmd(func(cmd *Now) {
 		assert.Equal(t, cmd, &Now{})
@@ -113,11 +138,11 @@ func TestEffectsTestRunnerErrorSingleTwoDeep(t *testing.T) {
 	body, err := testRunnerFn(ctx)
 	assert.Equal(t, err.Error(), "oops")
 	assert.Equal(t, "", body)
-	assert.Nil(t, ctx.Finished())
+	ctx.Finished(t)
 }
 
 func TestEffectsTestRunnerErrorInSeries(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t)
 
 	ctx.Cmd(func(cmd *Now) {
 		assert.Equal(t, cmd, &Now{})
@@ -137,11 +162,11 @@ func TestEffectsTestRunnerErrorInSeries(t *testing.T) {
 	body, err := testRunnerFn(ctx)
 	assert.Equal(t, err.Error(), "oops")
 	assert.Equal(t, "", body)
-	assert.Nil(t, ctx.Finished())
+	ctx.Finished(t)
 }
 
 func TestEffectsTestRunnerErrorInConcurrent(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t)
 
 	ctx.Cmd(func(cmd *Now) {
 		assert.Equal(t, cmd, &Now{})
@@ -169,66 +194,58 @@ func TestEffectsTestRunnerErrorInConcurrent(t *testing.T) {
 	body, err := testRunnerFn(ctx)
 	assert.Equal(t, err.Error(), "oops")
 	assert.Equal(t, "", body)
-	assert.Nil(t, ctx.Finished())
+	ctx.Finished(t)
 }
 
 func TestEffectsTestRunnerTooManyStepsInTest(t *testing.T) {
-	ctx := effects.NewTestContext()
-
-	ctx.Cmd(func(cmd *Now) error {
-		return errors.New("oops")
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
+
+		ctx.Cmd(func(cmd *Now) error {
+			return errors.New("oops")
+		})
+
+		ctx.Cmd(func(cmd *Get) {
+			assert.Equal(t, cmd, &Get{URL: "https://www.swapi.co/api/people/1"})
+			cmd.Body = "{...}"
+		})
+
+		body, err := testRunnerFn(ctx)
+		assert.Equal(t, err.Error(), "oops")
+		assert.Equal(t, "", body)
+		ctx.Finished(t)
 	})
 
-	ctx.Cmd(func(cmd *Get) {
-		assert.Equal(t, cmd, &Get{URL: "https://www.swapi.co/api/people/1"})
-		cmd.Body = "{...}"
-	})
-
-	body, err := testRunnerFn(ctx)
-	assert.Equal(t, err.Error(), "oops")
-	assert.Equal(t, "", body)
-	finishError := ctx.Finished()
-	assert.NotNil(t, ctx.Finished())
-	assert.Equal(t, finishError.Error(), "expected 2 cmds to be processed but processed 1")
+	assert.Contains(t, output, "expected 2 cmds to be processed but processed 1")
 }
 
 func TestEffectsTestRunnerNoStepsSingle(t *testing.T) {
-	ctx := effects.NewTestContext()
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
 
-	defer func() {
-		r := recover()
-		if r == nil {
-			t.Errorf("The code did not panic")
-		} else {
-			assert.Equal(t, "attempting to process a command (1) not specified in test", r)
-		}
-	}()
+		testRunnerFn(ctx)
+	})
 
-	testRunnerFn(ctx)
+	assert.Contains(t, output, "attempting to process a command (number 1 in your function) not specified in your test")
 }
 
 func TestEffectsTestRunnerTooFewStepsSingle(t *testing.T) {
-	ctx := effects.NewTestContext()
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
 
-	ctx.Cmd(func(cmd *Now) {
-		assert.Equal(t, cmd, &Now{})
-		cmd.Time = time.Now()
-	})
+		ctx.Cmd(func(cmd *Now) {
+			assert.Equal(t, cmd, &Now{})
+			cmd.Time = time.Now()
+		})
 
-	defer func() {
-		r := recover()
-		if r == nil {
-			t.Errorf("The code did not panic")
-		} else {
-			assert.Equal(t, "attempting to process a command (2) not specified in test", r)
-		}
-	}()
+		testRunnerFn(ctx)
+	})
 
-	testRunnerFn(ctx)
+	assert.Contains(t, output, "attempting to process a command (number 2 in your function) not specified in your test")
 }
 
 func TestEffectsTestRunnerTooFewStepsSeries(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd(func(cmd *Now) {
 		cmd.Time = time.Now()
@@ -244,7 +261,7 @@ func TestEffectsTestRunnerTooFewStepsSeries(t *testing.T) {
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "attempting to process a command (3) not specified in test", r)
+			assert.Contains(t, r, "attempting to process a command (3) not specified in test")
 		}
 	}()
 
@@ -252,7 +269,7 @@ func TestEffectsTestRunnerTooFewStepsSeries(t *testing.T) {
 }
 
 func TestEffectsTestRunnerTooFewStepsConcurrent(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd(func(cmd *Now) {
 		cmd.Time = time.Now()
@@ -275,7 +292,7 @@ func TestEffectsTestRunnerTooFewStepsConcurrent(t *testing.T) {
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "attempting to process a command (4) not specified in test", r)
+			assert.Contains(t, r, "attempting to process a command (4) not specified in test")
 		}
 	}()
 
@@ -283,7 +300,7 @@ func TestEffectsTestRunnerTooFewStepsConcurrent(t *testing.T) {
 }
 
 func TestEffectsTestRunnerTestExpectsWrongType(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd(func(cmd *Get) {
 		assert.Equal(t, cmd, &Get{URL: "https://www.swapi.co/api/people/1"})
@@ -295,7 +312,7 @@ func TestEffectsTestRunnerTestExpectsWrongType(t *testing.T) {
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "Your test expected a command of type *effects_test.Get, but the actual command was of type *effects_test.Now", r)
+			assert.Contains(t, r, "Your test expected a command of type *effects_test.Get, but the actual command was of type *effects_test.Now")
 		}
 	}()
 
@@ -303,7 +320,7 @@ func TestEffectsTestRunnerTestExpectsWrongType(t *testing.T) {
 }
 
 func TestEffectsTestRunnerTestExpectsWrongTypeWithResult(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd(func(cmd *Get) error {
 		assert.Equal(t, cmd, &Get{URL: "https://www.swapi.co/api/people/1"})
@@ -316,7 +333,7 @@ func TestEffectsTestRunnerTestExpectsWrongTypeWithResult(t *testing.T) {
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "Your test expected a command of type *effects_test.Get, but the actual command was of type *effects_test.Now", r)
+			assert.Contains(t, r, "Your test expected a command of type *effects_test.Get, but the actual command was of type *effects_test.Now")
 		}
 	}()
 
@@ -324,7 +341,7 @@ func TestEffectsTestRunnerTestExpectsWrongTypeWithResult(t *testing.T) {
 }
 
 func TestEffectsTestRunnerTestCmdFunctionReturnsNonError(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd(func(cmd *Now) string { return "" })
 
@@ -333,7 +350,7 @@ func TestEffectsTestRunnerTestCmdFunctionReturnsNonError(t *testing.T) {
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "functions passed to ctx.Cmd(...) must return an error or return nothing.  In your test, the function is returning a value of type `string`", r)
+			assert.Contains(t, r, "functions passed to ctx.Cmd(...) must return an error or return nothing.  In your test, the function is returning a value of type `string`")
 		}
 	}()
 
@@ -341,7 +358,7 @@ func TestEffectsTestRunnerTestCmdFunctionReturnsNonError(t *testing.T) {
 }
 
 func TestEffectsTestRunnerTestCmdShouldOnlyTakeOneArgument(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd(func(c1 *Now, c2 *Now) {})
 
@@ -350,7 +367,7 @@ func TestEffectsTestRunnerTestCmdShouldOnlyTakeOneArgument(t *testing.T) {
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "ctx.Cmd(...) must receive a function that takes only 1 argument.  In your test, you're passing in a function that takes 2 arguments", r)
+			assert.Contains(t, r, "ctx.Cmd(...) must receive a function that takes only 1 argument.  In your test, you're passing in a function that takes 2 arguments")
 		}
 	}()
 
@@ -358,7 +375,7 @@ func TestEffectsTestRunnerTestCmdShouldOnlyTakeOneArgument(t *testing.T) {
 }
 
 func TestEffectsTestRunnerTestPassesNonFunctionToCmd(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd("NOT A FUNCTION")
 
@@ -367,7 +384,7 @@ func TestEffectsTestRunnerTestPassesNonFunctionToCmd(t *testing.T) {
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "ctx.Cmd(...) must receive a function.  In your test, you're passing in a value of type `string`", r)
+			assert.Contains(t, r, "ctx.Cmd(...) must receive a function.  In your test, you're passing in a value of type `string`")
 		}
 	}()
 
@@ -375,7 +392,7 @@ func TestEffectsTestRunnerTestPassesNonFunctionToCmd(t *testing.T) {
 }
 
 func TestEffectsTestRunnerTestCmdShouldTakeAFunctionWithAPtrArgument(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd(func(c1 Now) {})
 
@@ -384,7 +401,7 @@ func TestEffectsTestRunnerTestCmdShouldTakeAFunctionWithAPtrArgument(t *testing.
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "ctx.Cmd(...) must receive a function that takes a single argument of kind ptr (pointer) or a slice of pointers", r)
+			assert.Contains(t, r, "ctx.Cmd(...) must receive a function that takes a single argument of kind ptr (pointer) or a slice of pointers")
 		}
 	}()
 
@@ -392,7 +409,7 @@ func TestEffectsTestRunnerTestCmdShouldTakeAFunctionWithAPtrArgument(t *testing.
 }
 
 func TestEffectsTestRunnerTestCmdShouldTakeAFunctionWithASliceOfPtrArgument(t *testing.T) {
-	ctx := effects.NewTestContext()
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
 
 	ctx.Cmd(func(c1 []Now) {})
 
@@ -401,9 +418,609 @@ func TestEffectsTestRunnerTestCmdShouldTakeAFunctionWithASliceOfPtrArgument(t *t
 		if r == nil {
 			t.Errorf("The code did not panic")
 		} else {
-			assert.Equal(t, "ctx.Cmd(...) must receive a function that takes a single argument of kind ptr (pointer) or a slice of pointers", r)
+			assert.Contains(t, r, "ctx.Cmd(...) must receive a function that takes a single argument of kind ptr (pointer) or a slice of pointers")
 		}
 	}()
 
 	testRunnerFn(ctx)
 }
+
+func TestEffectsTestRunnerMixedTypes(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Cmd(func(cmds []interface{}) {
+		assert.Equal(t, 2, len(cmds))
+		cmds[0].(*Now).Time = now
+		cmds[1].(*Get).Body = "{...}"
+	})
+
+	n := Now{}
+	g := Get{}
+	err := ctx.DoSeries([]interface{}{&n, &g})
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+	assert.Equal(t, "{...}", g.Body)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerMixedTypesWithNonPtr(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
+
+	ctx.Cmd(func(cmds []interface{}) {})
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Errorf("The code did not panic")
+		} else {
+			assert.Contains(t, r, "Your test expected a slice of cmd pointers, but the actual slice contains a `struct` at index 1")
+		}
+	}()
+
+	ctx.DoConcurrent([]interface{}{&Now{}, Now{}})
+}
+
+func TestEffectsTestRunnerUnordered(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.Unordered())
+
+	// Registered in the reverse order of testRunnerFn
+	ctx.Cmd(func(cmds []*Now) {
+		for _, n := range cmds {
+			n.Time = now
+		}
+	})
+	ctx.Cmd(func(cmds []*Now) {
+		for _, n := range cmds {
+			n.Time = now
+		}
+	})
+	ctx.Cmd(func(cmd *Get) {
+		cmd.Body = "{...}"
+	})
+	ctx.Cmd(func(cmd *Now) {
+		cmd.Time = now
+	})
+
+	body, err := testRunnerFn(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "{...}", body)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerInAnyOrderWhen(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Cmd(func(cmd *Now) {
+		cmd.Time = now
+	})
+	ctx.InAnyOrder(func() {
+		ctx.Cmd(func(cmd *Get) {
+			cmd.Body = "b"
+		}).When(func(cmd *Get) bool {
+			return cmd.URL == "/b"
+		})
+		ctx.Cmd(func(cmd *Get) {
+			cmd.Body = "a"
+		}).When(func(cmd *Get) bool {
+			return cmd.URL == "/a"
+		})
+	})
+
+	n := Now{}
+	a := Get{URL: "/a"}
+	b := Get{URL: "/b"}
+	assert.Nil(t, ctx.Do(&n))
+	assert.Nil(t, ctx.Do(&a))
+	assert.Nil(t, ctx.Do(&b))
+	assert.Equal(t, now, n.Time)
+	assert.Equal(t, "a", a.Body)
+	assert.Equal(t, "b", b.Body)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerInAnyOrderKeepsGroupsOrdered(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
+		ctx.InAnyOrder(func() {
+			ctx.Cmd(func(cmd *Get) {})
+			ctx.Cmd(func(cmd *Get) {})
+		})
+		ctx.Cmd(func(cmd *Now) {})
+
+		ctx.Do(&Now{})
+	})
+	assert.Contains(t, output, "command number 1 in your function does not match any of the expectations that may be processed in any order")
+	assert.Contains(t, output, "ctx.Cmd(...) expecting a *effects_test.Get")
+}
+
+func TestEffectsTestRunnerMismatchAfterSkippableExpectation(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
+		ctx.Expect(&Now{}).AnyTimes()
+		ctx.Expect(&Get{URL: "/a"})
+
+		ctx.Do(&Get{URL: "/b"})
+	})
+	assert.Contains(t, output, "command number 1 in your function does not match any of the next expectations that may be processed")
+	assert.NotContains(t, output, "in any order")
+}
+
+func TestEffectsTestRunnerWhenShouldTakeAMatchingFunction(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Errorf("The code did not panic")
+		} else {
+			assert.Equal(t, "ctx.Cmd(...).When(...) must receive a function that takes a `*effects_test.Get` and returns a bool.  In your test, you're passing in a value of type `func(*effects_test.Now) bool`", r)
+		}
+	}()
+
+	ctx.Cmd(func(cmd *Get) {}).When(func(cmd *Now) bool { return true })
+}
+
+func TestEffectsTestRunnerFinishedReportsLeftovers(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t, effects.Unordered())
+		ctx.Cmd(func(cmd *Get) {})
+		ctx.Cmd(func(cmd *Now) {})
+
+		ctx.Do(&Now{})
+		ctx.Finished(t)
+	})
+	assert.Contains(t, output, "expected 2 cmds to be processed but processed 1.  The expectations that were not processed are:\n")
+	assert.Contains(t, output, "ctx.Cmd(...) expecting a *effects_test.Get")
+	assert.NotContains(t, output, "expecting a *effects_test.Now")
+}
+
+func TestEffectsTestRunnerExpandBatches(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.ExpandBatches())
+
+	ctx.Cmd(func(cmd *Now) {
+		cmd.Time = now
+	})
+	ctx.Cmd(func(cmd *Get) {
+		cmd.Body = "{...}"
+	})
+
+	// Series
+	for i := 0; i < 3; i++ {
+		ctx.Cmd(func(cmd *Now) {
+			cmd.Time = now
+		})
+	}
+
+	// Concurrent
+	for i := 0; i < 3; i++ {
+		ctx.Cmd(func(cmd *Now) {
+			cmd.Time = now
+		})
+	}
+
+	body, err := testRunnerFn(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "{...}", body)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerExpandBatchesConcurrentInAnyOrder(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.ExpandBatches())
+
+	ctx.Cmd(func(cmd *Get) {
+		cmd.Body = "get"
+	})
+	ctx.Cmd(func(cmd *Now) error {
+		return errors.New("oops")
+	})
+
+	n := Now{}
+	g := Get{}
+	err := ctx.DoConcurrent([]interface{}{&n, &g})
+	assert.Equal(t, "oops", err.Error())
+	assert.Equal(t, "get", g.Body)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerExpandBatchesSeriesStopsOnError(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.ExpandBatches())
+
+	ctx.Cmd(func(cmd *Now) error {
+		return errors.New("oops")
+	})
+
+	err := ctx.DoSeries([]*Now{{}, {}})
+	assert.Equal(t, "oops", err.Error())
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerExpandBatchesSeriesIsOrdered(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t, effects.ExpandBatches())
+		ctx.Cmd(func(cmd *Get) {})
+		ctx.Cmd(func(cmd *Now) {})
+
+		ctx.DoSeries([]interface{}{&Now{}, &Get{}})
+	})
+	assert.Contains(t, output, "Your test expected a command of type *effects_test.Get, but the actual command was of type *effects_test.Now")
+}
+
+func TestEffectsTestRunnerExpandBatchesConcurrentSkipsSatisfied(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.ExpandBatches())
+	ctx.Cmd(func(cmd *Now) {}).AnyTimes()
+	ctx.Cmd(func(cmd *Get) {})
+	ctx.Cmd(func(cmd *Get) {})
+
+	assert.Nil(t, ctx.DoConcurrent([]*Get{{}, {}}))
+	assert.Nil(t, ctx.DoConcurrent([]*Get{}))
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerExpandBatchesConcurrentMismatch(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t, effects.ExpandBatches())
+		ctx.Cmd(func(cmd *Now) {})
+		ctx.Cmd(func(cmd *Now) {})
+
+		ctx.DoConcurrent([]interface{}{&Now{}, &Get{}})
+	})
+	assert.Contains(t, output, "command number 2 in your function does not match any of the expectations that may be processed in any order")
+}
+
+func TestEffectsTestRunnerConcurrentCallers(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.Unordered())
+
+	const workers = 20
+	for i := 0; i < workers; i++ {
+		ctx.Cmd(func(cmd *Get) {
+			cmd.Body = cmd.URL
+		})
+	}
+
+	gets := make([]*Get, workers)
+	errs := make(chan error, workers)
+	for i := range gets {
+		gets[i] = &Get{URL: fmt.Sprintf("/%d", i)}
+		go func(g *Get) {
+			errs <- ctx.Do(g)
+		}(gets[i])
+	}
+
+	for i := 0; i < workers; i++ {
+		assert.Nil(t, <-errs)
+	}
+	for _, g := range gets {
+		assert.Equal(t, g.URL, g.Body)
+	}
+	assert.Equal(t, workers, ctx.CmdIndex)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerConcurrentCallersConsumeEachExpectationOnce(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	calls := make(chan int, 2)
+	ctx.Cmd(func(cmd *Now) {
+		calls <- 1
+	})
+	ctx.Cmd(func(cmd *Now) {
+		calls <- 2
+	})
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			ctx.DoAsync(&Now{}).Wait()
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+
+	assert.ElementsMatch(t, []int{1, 2}, []int{<-calls, <-calls})
+	ctx.Finished(t)
+}
+
+func pollFn(ctx effects.Context) (string, error) {
+	for {
+		g := Get{URL: "/status"}
+		err := ctx.Do(&g)
+		if err != nil {
+			return "", err
+		}
+		if g.Body == "done" {
+			break
+		}
+	}
+
+	n := Now{}
+	err := ctx.Do(&n)
+	return n.Time.String(), err
+}
+
+func TestEffectsTestRunnerTimes(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Expect(&Get{URL: "/status"}).Returns(Get{Body: "pending"}).Times(3)
+	ctx.Expect(&Get{URL: "/status"}).Returns(Get{Body: "done"})
+	ctx.Expect(&Now{}).Returns(Now{Time: now})
+
+	result, err := pollFn(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, now.String(), result)
+	assert.Equal(t, 5, ctx.CmdIndex)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerAnyTimesMaySkip(t *testing.T) {
+	for _, pending := range []int{0, 1, 4} {
+		ctx := effects.NewTestContext(t)
+
+		calls := 0
+		ctx.Cmd(func(cmd *Get) {
+			calls++
+			if calls > pending {
+				cmd.Body = "done"
+			}
+		}).AtLeast(1)
+		ctx.Cmd(func(cmd *Now) {
+			cmd.Time = now
+		}).AnyTimes()
+
+		_, err := pollFn(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, pending+1, calls)
+		ctx.Finished(t)
+	}
+}
+
+func TestEffectsTestRunnerAtMost(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Expect(&Get{URL: "/status"}).Returns(Get{Body: "done"}).AtMost(2)
+	ctx.Expect(&Now{}).AtMost(2)
+	ctx.Finished(t)
+
+	_, err := pollFn(ctx)
+	assert.Nil(t, err)
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerAtMostExceeded(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
+		ctx.Expect(&Get{URL: "/status"}).AtMost(2)
+
+		pollFn(ctx)
+	})
+	assert.Contains(t, output, "attempting to process a command (number 3 in your function) not specified in your test")
+}
+
+func TestEffectsTestRunnerContradictoryBounds(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
+
+	assert.PanicsWithValue(t, "ctx.Cmd(...).AtMost(2) contradicts the lower bound of 3 already set", func() {
+		ctx.Cmd(func(cmd *Now) {}).AtLeast(3).AtMost(2)
+	})
+	assert.PanicsWithValue(t, "ctx.Cmd(...).AtLeast(3) contradicts the upper bound of 2 already set", func() {
+		ctx.Cmd(func(cmd *Now) {}).AtMost(2).AtLeast(3)
+	})
+	assert.PanicsWithValue(t, "ctx.Cmd(...).AtLeast(3) contradicts the upper bound of 2 already set", func() {
+		ctx.Cmd(func(cmd *Now) {}).Times(2).AtLeast(3)
+	})
+
+	// bounds that agree are kept
+	ctx = effects.NewTestContext(t)
+	ctx.Cmd(func(cmd *Now) {}).AtMost(3).AtLeast(2)
+	assert.Nil(t, ctx.Do(&Now{}))
+	assert.Nil(t, ctx.Do(&Now{}))
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerFinishedReportsRepetition(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
+		ctx.Cmd(func(cmd *Get) {}).Times(3)
+		ctx.Cmd(func(cmd *Now) {}).AtLeast(1).AtMost(2)
+
+		ctx.Do(&Get{})
+		ctx.Finished(t)
+	})
+	assert.Contains(t, output, "expected 4 cmds to be processed but processed 1")
+	assert.Contains(t, output, "ctx.Cmd(...) expecting a *effects_test.Get (expected 3 times, processed 1)")
+	assert.Contains(t, output, "ctx.Cmd(...) expecting a *effects_test.Now (expected between 1 and 2 times, processed 0)")
+}
+
+func TestEffectsTestRunnerFinishedReportsLocations(t *testing.T) {
+	_, _, line, _ := runtime.Caller(0)
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
+		ctx.Cmd(func(cmd *Now) {})
+		ctx.Expect(&Get{URL: "/a"})
+
+		ctx.Do(&Now{})
+		ctx.Finished(t)
+	})
+	assert.Contains(t, output, fmt.Sprintf("effects_test_runner_test.go:%d: ctx.Expect(Eq(&effects_test.Get{URL:\"/a\", Body:\"\"}))", line+4))
+	assert.NotContains(t, output, fmt.Sprintf("effects_test_runner_test.go:%d", line+3))
+}
+
+func TestEffectsTestRunnerMismatchReportsLocation(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
+
+	_, _, line, _ := runtime.Caller(0)
+	ctx.Cmd(func(cmd *Get) {})
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Errorf("The code did not panic")
+		} else {
+			assert.Contains(t, r, "Your test expected a command of type *effects_test.Get, but the actual command was of type *effects_test.Now\n")
+			assert.Contains(t, r, fmt.Sprintf("The expectation is effects_test_runner_test.go:%d: ctx.Cmd(...) expecting a *effects_test.Get\n", line+1))
+			assert.Contains(t, r, "The command was:\n&effects_test.Now{")
+		}
+	}()
+
+	ctx.Do(&Now{})
+}
+
+// fakeTB records the failures reported by a TestContext.
+type fakeTB struct {
+	testing.TB
+
+	mu       sync.Mutex
+	errors   []string
+	cleanups []func()
+}
+
+func (tb *fakeTB) Errorf(format string, args ...interface{}) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+func (tb *fakeTB) Failed() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return len(tb.errors) > 0
+}
+
+func (tb *fakeTB) Cleanup(fn func()) {
+	tb.cleanups = append(tb.cleanups, fn)
+}
+
+func (tb *fakeTB) finish() {
+	for i := len(tb.cleanups) - 1; i >= 0; i-- {
+		tb.cleanups[i]()
+	}
+}
+
+func TestEffectsTestRunnerFailureStopsFunction(t *testing.T) {
+	tb := &fakeTB{}
+	ctx := effects.NewTestContext(tb)
+
+	ctx.Cmd(func(cmd *Now) {})
+	ctx.Cmd(func(cmd *Now) {})
+
+	body, err := testRunnerFn(ctx)
+	assert.Equal(t, effects.ErrTestFailure, err)
+	assert.Equal(t, "", body)
+	assert.Equal(t, effects.ErrTestFailure, ctx.Err())
+	assert.Equal(t, 1, len(tb.errors))
+	assert.Contains(t, tb.errors[0], "Your test expected a command of type *effects_test.Now, but the actual command was of type *effects_test.Get")
+
+	// Leftovers are not reported once the test failed
+	tb.finish()
+	assert.Equal(t, 1, len(tb.errors))
+}
+
+func TestEffectsTestRunnerFailureInGoroutine(t *testing.T) {
+	tb := &fakeTB{}
+	ctx := effects.NewTestContext(tb)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- ctx.DoConcurrent([]*Now{{}})
+		}()
+	}
+
+	assert.Equal(t, effects.ErrTestFailure, <-errs)
+	assert.Equal(t, effects.ErrTestFailure, <-errs)
+	assert.Equal(t, 2, len(tb.errors))
+	assert.Contains(t, tb.errors[0], "not specified in test")
+}
+
+func TestEffectsTestRunnerFinishedOnCleanup(t *testing.T) {
+	tb := &fakeTB{}
+	ctx := effects.NewTestContext(tb)
+	ctx.Cmd(func(cmd *Now) {})
+	ctx.Cmd(func(cmd *Get) {})
+
+	assert.Nil(t, ctx.Do(&Now{}))
+	tb.finish()
+	assert.Equal(t, 1, len(tb.errors))
+	assert.Contains(t, tb.errors[0], "expected 2 cmds to be processed but processed 1")
+
+	// An explicit call to Finished is not repeated
+	tb = &fakeTB{}
+	ctx = effects.NewTestContext(tb)
+	ctx.Cmd(func(cmd *Now) {})
+	ctx.Finished(tb)
+	tb.finish()
+	assert.Equal(t, 1, len(tb.errors))
+}
+
+func TestEffectsTestRunnerFallback(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.Fallback(interpreter))
+
+	ctx.Expect(&Get{URL: "https://www.swapi.co/api/people/1"}).Returns(Get{Body: "{...}"})
+
+	body, err := testRunnerFn(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "{...}", body)
+
+	log := ctx.Log()
+	assert.Equal(t, 4, len(log))
+	assert.False(t, log[0].Stubbed())
+	assert.Equal(t, now, log[0].Cmd.(*Now).Time)
+	assert.True(t, log[1].Stubbed())
+	assert.Equal(t, "https://www.swapi.co/api/people/1", log[1].Cmd.(*Get).URL)
+	assert.False(t, log[2].Stubbed())
+	assert.False(t, log[3].Stubbed())
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerFallbackMismatch(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t, effects.Fallback(interpreter))
+		ctx.Expect(&Get{URL: "https://www.swapi.co/api/people/1"}).Returns(Get{Body: "{...}"})
+
+		ctx.Do(&Now{})
+		ctx.Do(&Get{URL: "https://www.swapi.co/api/people/2"})
+	})
+	assert.Contains(t, output, "command number 1 in your function does not match ctx.Expect(")
+	assert.Contains(t, output, `URL: expected "https://www.swapi.co/api/people/1", got "https://www.swapi.co/api/people/2"`)
+
+	output = expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t, effects.Fallback(interpreter))
+		ctx.InAnyOrder(func() {
+			ctx.Expect(&Get{URL: "/a"})
+			ctx.Expect(&Get{URL: "/b"})
+		})
+
+		ctx.Do(&Get{URL: "/c"})
+	})
+	assert.Contains(t, output, "command number 1 in your function does not match any of the expectations that may be processed in any order")
+}
+
+func TestEffectsTestRunnerFallbackErrors(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.Fallback(interpreter), effects.ExpandBatches())
+
+	ctx.Cmd(func(cmd *Now) error {
+		return errors.New("stubbed")
+	})
+
+	err := ctx.DoConcurrent([]interface{}{&ErrorOut{}, &Panic{}})
+	assert.NotNil(t, err)
+	assert.Equal(t, "stubbed", ctx.Do(&Now{}).Error())
+
+	log := ctx.Log()
+	assert.Equal(t, 3, len(log))
+	assert.Equal(t, "oops", log[0].Err.Error())
+	assert.IsType(t, effects.InterpreterError{}, log[1].Err)
+	assert.True(t, log[2].Stubbed())
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerFallbackCallable(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.Fallback(interpreter))
+
+	n := Now{}
+	err := ctx.Do(&effects.Sequence{&n})
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+	assert.Equal(t, 1, len(ctx.Log()))
+	ctx.Finished(t)
+}
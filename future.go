@@ -0,0 +1,81 @@
+package effects
+
+import (
+	"context"
+)
+
+// Future is a handle to a command started with DoAsync.
+type Future interface {
+	// Wait blocks until the command finishes and returns its error, or the
+	// context's error if the future was cancelled first.
+	Wait() error
+	// Done is closed when Wait will no longer block.
+	Done() <-chan struct{}
+	// Cancel cancels the context the command runs with.
+	Cancel()
+}
+
+type future struct {
+	done   chan struct{}
+	err    error
+	cancel context.CancelFunc
+}
+
+func (f *future) Wait() error {
+	<-f.done
+	return f.err
+}
+
+func (f *future) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *future) Cancel() {
+	f.cancel()
+}
+
+func resolvedFuture(err error) Future {
+	f := &future{
+		done:   make(chan struct{}),
+		err:    err,
+		cancel: func() {},
+	}
+	close(f.done)
+	return f
+}
+
+// DoAsync starts cmd in a goroutine and returns a Future for its result.  The
+// command runs with a context derived from ctx, so it is cancelled when ctx
+// ends or when the future is cancelled.  A cancelled future resolves with the
+// context's error once the command returns, so the command may be read after
+// Wait returns.
+func (ctx RealContext) DoAsync(cmd interface{}) Future {
+	child, cancel := context.WithCancel(ctx.Context)
+	asyncCtx := ctx
+	asyncCtx.Context = child
+
+	f := &future{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- asyncCtx.Do(cmd)
+	}()
+
+	go func() {
+		select {
+		case err := <-result:
+			f.err = err
+		case <-child.Done():
+			// The interpreter may still be writing to cmd
+			<-result
+			f.err = child.Err()
+		}
+		cancel()
+		close(f.done)
+	}()
+
+	return f
+}
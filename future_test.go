@@ -0,0 +1,84 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEffectsDoAsync(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	n := Now{}
+	f := ctx.DoAsync(&n)
+	assert.Nil(t, f.Wait())
+	assert.Equal(t, now, n.Time)
+
+	select {
+	case <-f.Done():
+	default:
+		assert.Fail(t, "future was not done after Wait returned")
+	}
+}
+
+func TestEffectsDoAsyncError(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	f := ctx.DoAsync(&ErrorOut{})
+	assert.Equal(t, "oops", f.Wait().Error())
+
+	f = ctx.DoAsync(Now{})
+	assert.Equal(t, "ctx.Do(...) must receive a ptr", f.Wait().Error())
+}
+
+func TestEffectsDoAsyncCancel(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	n := NeverReturn{}
+	f := ctx.DoAsync(&n)
+	f.Cancel()
+	assert.Equal(t, context.Canceled, f.Wait())
+
+	// the interpreter has returned, so the command may be read
+	assert.True(t, n.ContextDone)
+}
+
+func TestEffectsDoAsyncCancelledWithParentContext(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	ctx := effects.NewContext(parent, interpreter)
+
+	n := NeverReturn{}
+	f := ctx.DoAsync(&n)
+	cancel()
+
+	select {
+	case <-f.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "future was not cancelled with its context")
+	}
+	assert.Equal(t, context.Canceled, f.Wait())
+	assert.True(t, n.ContextDone)
+}
+
+func TestEffectsTestRunnerDoAsync(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Cmd(func(cmd *Get) {
+		cmd.Body = "{...}"
+	})
+	ctx.Cmd(func(cmd *Now) error {
+		return errors.New("oops")
+	})
+
+	g := Get{}
+	getFuture := ctx.DoAsync(&g)
+	nowFuture := ctx.DoAsync(&Now{})
+
+	assert.Nil(t, getFuture.Wait())
+	assert.Equal(t, "{...}", g.Body)
+	assert.Equal(t, "oops", nowFuture.Wait().Error())
+	ctx.Finished(t)
+}
@@ -1,9 +1,14 @@
 module github.com/orourkedd/effects
 
-go 1.12
+go 1.20
 
 require (
 	github.com/imroc/req v0.2.3
 	github.com/sanity-io/litter v1.1.0
 	github.com/stretchr/testify v1.3.0
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+)
@@ -0,0 +1,289 @@
+package effects
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NodeStatus int
+
+const (
+	NodePending NodeStatus = iota
+	NodeSucceeded
+	NodeFailed
+	NodeSkipped
+)
+
+func (s NodeStatus) String() string {
+	switch s {
+	case NodeSucceeded:
+		return "succeeded"
+	case NodeFailed:
+		return "failed"
+	case NodeSkipped:
+		return "skipped"
+	}
+	return "pending"
+}
+
+// NodeError is the error of a node in a Graph.
+type NodeError struct {
+	Node  string
+	Cause error
+}
+
+func (e NodeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Node, e.Cause.Error())
+}
+
+func (e NodeError) Unwrap() error {
+	return e.Cause
+}
+
+// DependencyError is the error of a node that was skipped because one of its
+// dependencies did not succeed.
+type DependencyError struct {
+	Dependency string
+}
+
+func (e DependencyError) Error() string {
+	return fmt.Sprintf("dependency `%s` did not succeed", e.Dependency)
+}
+
+type graphNode struct {
+	name string
+	deps []string
+	cmd  interface{}
+	fn   func(map[string]interface{}) (interface{}, error)
+
+	status   NodeStatus
+	err      error
+	started  time.Time
+	finished time.Time
+	done     chan struct{}
+}
+
+// Graph runs commands whose inputs depend on the results of other commands.
+// Every node runs as soon as all of its dependencies have succeeded, so
+// independent nodes run concurrently.  When a node fails, the nodes that
+// depend on it are skipped.
+type Graph struct {
+	nodes  []*graphNode
+	byName map[string]*graphNode
+	errs   []error
+}
+
+func NewGraph() *Graph {
+	return &Graph{
+		byName: map[string]*graphNode{},
+	}
+}
+
+// Add adds a node named name that runs cmd, a cmd pointer, after deps.
+func (g *Graph) Add(name string, cmd interface{}, deps ...string) *Graph {
+	return g.add(&graphNode{
+		name: name,
+		deps: deps,
+		cmd:  cmd,
+	})
+}
+
+// AddFunc adds a node named name whose command is built by fn after deps have
+// succeeded.  fn receives the commands of deps by node name.
+func (g *Graph) AddFunc(name string, fn func(results map[string]interface{}) (interface{}, error), deps ...string) *Graph {
+	return g.add(&graphNode{
+		name: name,
+		deps: deps,
+		fn:   fn,
+	})
+}
+
+func (g *Graph) add(node *graphNode) *Graph {
+	if _, ok := g.byName[node.name]; ok {
+		g.errs = append(g.errs, fmt.Errorf("node `%s` was added to the graph more than once", node.name))
+		return g
+	}
+	g.nodes = append(g.nodes, node)
+	g.byName[node.name] = node
+	return g
+}
+
+// Cmd returns the command run by the node called name.
+func (g *Graph) Cmd(name string) interface{} {
+	node, ok := g.byName[name]
+	if !ok {
+		return nil
+	}
+	return node.cmd
+}
+
+// Status returns the status of the node called name after Run.
+func (g *Graph) Status(name string) NodeStatus {
+	node, ok := g.byName[name]
+	if !ok {
+		return NodePending
+	}
+	return node.status
+}
+
+func (g *Graph) check() error {
+	errs := append([]error{}, g.errs...)
+
+	for _, node := range g.nodes {
+		for _, dep := range node.deps {
+			if _, ok := g.byName[dep]; !ok {
+				errs = append(errs, fmt.Errorf("node `%s` depends on `%s`, which is not in the graph", node.name, dep))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		// depth-first search for cycles
+		state := map[string]int{}
+		var visit func(node *graphNode, path []string) error
+		visit = func(node *graphNode, path []string) error {
+			path = append(path, node.name)
+			switch state[node.name] {
+			case 1:
+				return fmt.Errorf("the graph has a cycle: %s", strings.Join(path, " -> "))
+			case 2:
+				return nil
+			}
+			state[node.name] = 1
+			for _, dep := range node.deps {
+				err := visit(g.byName[dep], path)
+				if err != nil {
+					return err
+				}
+			}
+			state[node.name] = 2
+			return nil
+		}
+
+		for _, node := range g.nodes {
+			err := visit(node, nil)
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return AggregateError{Errors: errs}
+}
+
+// Run runs the graph and waits for every node to finish.  It returns an
+// AggregateError holding a NodeError for every node that did not succeed.
+func (g *Graph) Run(ctx Context) error {
+	err := g.check()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range g.nodes {
+		node.status = NodePending
+		node.err = nil
+		node.started = time.Time{}
+		node.finished = time.Time{}
+		node.done = make(chan struct{})
+		if node.fn != nil {
+			node.cmd = nil
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(g.nodes))
+
+	for _, node := range g.nodes {
+		go func(node *graphNode) {
+			defer wg.Done()
+			defer close(node.done)
+			g.runNode(ctx, node)
+		}(node)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, node := range g.nodes {
+		if node.err != nil {
+			errs = append(errs, NodeError{Node: node.name, Cause: node.err})
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return AggregateError{Errors: errs}
+}
+
+func (g *Graph) runNode(ctx Context, node *graphNode) {
+	results := map[string]interface{}{}
+	for _, name := range node.deps {
+		dep := g.byName[name]
+		<-dep.done
+		if dep.status != NodeSucceeded {
+			node.status = NodeSkipped
+			node.err = DependencyError{Dependency: name}
+			return
+		}
+		results[name] = dep.cmd
+	}
+
+	node.started = time.Now()
+	defer func() {
+		node.finished = time.Now()
+	}()
+
+	if node.fn != nil {
+		cmd, err := buildNodeCmd(node, results)
+		if err != nil {
+			node.status = NodeFailed
+			node.err = err
+			return
+		}
+		node.cmd = cmd
+	}
+
+	err := ctx.Do(node.cmd)
+	if err != nil {
+		node.status = NodeFailed
+		node.err = err
+		return
+	}
+	node.status = NodeSucceeded
+}
+
+func buildNodeCmd(node *graphNode, results map[string]interface{}) (cmd interface{}, err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = recoveredError(r, nil)
+		}
+	}()
+	return node.fn(results)
+}
+
+// Dump describes the nodes of the graph in the order they were added, with
+// their status, command, duration, dependencies and error.
+func (g *Graph) Dump() string {
+	b := strings.Builder{}
+	for _, node := range g.nodes {
+		fmt.Fprintf(&b, "%s [%s] %T", node.name, node.status, node.cmd)
+		if !node.started.IsZero() && !node.finished.IsZero() {
+			fmt.Fprintf(&b, " (%v)", node.finished.Sub(node.started))
+		}
+		if len(node.deps) > 0 {
+			fmt.Fprintf(&b, " <- %s", strings.Join(node.deps, ", "))
+		}
+		if node.err != nil {
+			fmt.Fprintf(&b, ": %s", node.err.Error())
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
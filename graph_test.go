@@ -0,0 +1,102 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func graphInterpreter(ctx effects.Context, command interface{}) error {
+	switch cmd := command.(type) {
+	case *Get:
+		if cmd.URL == "" {
+			return errors.New("no url")
+		}
+		time.Sleep(time.Millisecond * 20)
+		cmd.Body = "body of " + cmd.URL
+		return nil
+	}
+	return interpreter(ctx, command)
+}
+
+var durations = regexp.MustCompile(` \([^)]*\)`)
+
+func TestEffectsGraph(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), graphInterpreter)
+
+	g := effects.NewGraph().
+		Add("now", &Now{}).
+		Add("user", &Get{URL: "/user"}).
+		Add("orders", &Get{URL: "/orders"}).
+		AddFunc("summary", func(results map[string]interface{}) (interface{}, error) {
+			user := results["user"].(*Get)
+			orders := results["orders"].(*Get)
+			return &Get{URL: user.Body + " + " + orders.Body}, nil
+		}, "user", "orders")
+
+	err := g.Run(ctx)
+	assert.Nil(t, err)
+
+	assert.Equal(t, now, g.Cmd("now").(*Now).Time)
+	assert.Equal(t, "body of body of /user + body of /orders", g.Cmd("summary").(*Get).Body)
+	assert.Equal(t, effects.NodeSucceeded, g.Status("summary"))
+
+	assert.Equal(t, "now [succeeded] *effects_test.Now\n"+
+		"user [succeeded] *effects_test.Get\n"+
+		"orders [succeeded] *effects_test.Get\n"+
+		"summary [succeeded] *effects_test.Get <- user, orders\n", durations.ReplaceAllString(g.Dump(), ""))
+}
+
+func TestEffectsGraphFailurePropagation(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), graphInterpreter)
+
+	g := effects.NewGraph().
+		Add("broken", &Get{}).
+		Add("fine", &Get{URL: "/fine"}).
+		Add("child", &Get{URL: "/child"}, "broken").
+		AddFunc("grandchild", func(results map[string]interface{}) (interface{}, error) {
+			return &Now{}, nil
+		}, "child", "fine").
+		AddFunc("unbuildable", func(results map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("cannot build")
+		}, "fine")
+
+	err := g.Run(ctx)
+	assert.Equal(t, effects.AggregateError{Errors: []error{
+		effects.NodeError{Node: "broken", Cause: errors.New("no url")},
+		effects.NodeError{Node: "child", Cause: effects.DependencyError{Dependency: "broken"}},
+		effects.NodeError{Node: "grandchild", Cause: effects.DependencyError{Dependency: "child"}},
+		effects.NodeError{Node: "unbuildable", Cause: errors.New("cannot build")},
+	}}, err)
+
+	assert.Equal(t, effects.NodeSucceeded, g.Status("fine"))
+	assert.Equal(t, "broken [failed] *effects_test.Get: no url\n"+
+		"fine [succeeded] *effects_test.Get\n"+
+		"child [skipped] *effects_test.Get <- broken: dependency `broken` did not succeed\n"+
+		"grandchild [skipped] <nil> <- child, fine: dependency `child` did not succeed\n"+
+		"unbuildable [failed] <nil> <- fine: cannot build\n", durations.ReplaceAllString(g.Dump(), ""))
+}
+
+func TestEffectsGraphInvalid(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), graphInterpreter)
+
+	err := effects.NewGraph().
+		Add("a", &Now{}, "c").
+		Add("a", &Now{}).
+		Add("b", &Now{}, "missing").
+		Run(ctx)
+	assert.Equal(t, "node `a` was added to the graph more than once; "+
+		"node `a` depends on `c`, which is not in the graph; "+
+		"node `b` depends on `missing`, which is not in the graph", err.Error())
+
+	err = effects.NewGraph().
+		Add("a", &Now{}, "c").
+		Add("b", &Now{}, "a").
+		Add("c", &Now{}, "b").
+		Run(ctx)
+	assert.Equal(t, "the graph has a cycle: a -> c -> b -> a", err.Error())
+}
@@ -0,0 +1,110 @@
+package effects
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var contextType = reflect.TypeOf((*Context)(nil)).Elem()
+
+// WithHandler returns a child of ctx whose commands of one type are handled
+// by handler instead of the interpreter.  handler is a function such as
+//
+//	func(outer effects.Context, cmd *Now) error
+//
+// All other commands fall through to ctx.  Handlers can be nested; the
+// innermost one for a type wins.
+//
+// For a RealContext the handler applies to every command issued through the
+// child, including those issued by DoSeries, DoConcurrent and by Callable
+// commands, and to Callable commands themselves.  It runs after validation,
+// policies and middleware.  Calling outer.Do(cmd) with the command being
+// handled sends it straight to what the handler is scoped over, i.e. an outer
+// handler, the command's own Do method or the interpreter, without running
+// them again.  Other commands issued through outer are validated, authorized
+// and passed through the middleware as usual.
+//
+// For other Context implementations only Do is intercepted, and outer is ctx
+// itself.
+func WithHandler(ctx Context, handler interface{}) Context {
+	value := reflect.ValueOf(handler)
+	handlerType := value.Type()
+
+	if handlerType.Kind() != reflect.Func ||
+		handlerType.NumIn() != 2 ||
+		handlerType.In(0) != contextType ||
+		handlerType.In(1).Kind() != reflect.Ptr ||
+		handlerType.NumOut() != 1 ||
+		handlerType.Out(0) != errorType {
+		panic(fmt.Sprintf("effects.WithHandler(...) must receive a function like `func(effects.Context, *Cmd) error`, but received a `%v`", handlerType))
+	}
+
+	cmdType := handlerType.In(1)
+	handleWith := func(outer Context, cmd interface{}) error {
+		results := value.Call([]reflect.Value{reflect.ValueOf(&outer).Elem(), reflect.ValueOf(cmd)})
+		err, _ := results[0].Interface().(error)
+		return err
+	}
+
+	realCtx, ok := ctx.(RealContext)
+	if !ok {
+		return scopedContext{
+			Context: ctx,
+			cmdType: cmdType,
+			handle: func(cmd interface{}) error {
+				return handleWith(ctx, cmd)
+			},
+		}
+	}
+
+	previous := realCtx.dispatch
+	next := previous
+	if next == nil {
+		next = realCtx.interpret
+	}
+
+	realCtx.dispatch = func(child Context, cmd interface{}) error {
+		if reflect.TypeOf(cmd) != cmdType {
+			return next(child, cmd)
+		}
+
+		// The outer context keeps the child's context, which DoQuorum and
+		// DoRace cancel, but no longer applies this handler
+		outer, ok := child.(RealContext)
+		if !ok {
+			outer = realCtx
+		}
+		outer.dispatch = previous
+		return handleWith(directContext{RealContext: outer, cmd: cmd, next: next}, cmd)
+	}
+	return realCtx
+}
+
+// directContext is the outer context passed to handlers scoped over a
+// RealContext.  Its Do skips validation, policies and middleware for cmd, the
+// command being handled, which already went through them.
+type directContext struct {
+	RealContext
+	cmd  interface{}
+	next func(Context, interface{}) error
+}
+
+func (ctx directContext) Do(cmd interface{}) error {
+	if cmd == ctx.cmd {
+		return ctx.next(ctx.RealContext, cmd)
+	}
+	return ctx.RealContext.Do(cmd)
+}
+
+type scopedContext struct {
+	Context
+	cmdType reflect.Type
+	handle  func(interface{}) error
+}
+
+func (ctx scopedContext) Do(cmd interface{}) error {
+	if reflect.TypeOf(cmd) == ctx.cmdType {
+		return ctx.handle(cmd)
+	}
+	return ctx.Context.Do(cmd)
+}
@@ -0,0 +1,193 @@
+package effects_test
+
+import (
+	"context"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var later = now.Add(time.Hour)
+
+type NowPlusHour struct {
+	Time time.Time
+}
+
+func (c *NowPlusHour) Do(ctx effects.Context) error {
+	n := Now{}
+	err := ctx.Do(&n)
+	if err != nil {
+		return err
+	}
+	c.Time = n.Time.Add(time.Hour)
+	return nil
+}
+
+func TestEffectsWithHandler(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	scoped := effects.WithHandler(ctx, func(outer effects.Context, cmd *Now) error {
+		cmd.Time = later
+		return nil
+	})
+
+	n := Now{}
+	err := scoped.Do(&n)
+	assert.Nil(t, err)
+	assert.Equal(t, later, n.Time)
+
+	// the parent context is unaffected
+	n = Now{}
+	err = ctx.Do(&n)
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+
+	// other commands fall through to the parent interpreter
+	err = scoped.Do(&ErrorOut{})
+	assert.Equal(t, "oops", err.Error())
+}
+
+func TestEffectsWithHandlerDelegatesToOuterInterpreter(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	scoped := effects.WithHandler(ctx, func(outer effects.Context, cmd *Now) error {
+		err := outer.Do(cmd)
+		cmd.Time = cmd.Time.Add(time.Minute)
+		return err
+	})
+	nested := effects.WithHandler(scoped, func(outer effects.Context, cmd *Now) error {
+		err := outer.Do(cmd)
+		cmd.Time = cmd.Time.Add(time.Minute)
+		return err
+	})
+
+	n := Now{}
+	err := nested.Do(&n)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(2*time.Minute), n.Time)
+}
+
+func TestEffectsWithHandlerAppliesToBatchesAndCallables(t *testing.T) {
+	ctx := effects.WithHandler(effects.NewContext(context.Background(), interpreter), func(outer effects.Context, cmd *Now) error {
+		cmd.Time = later
+		return nil
+	})
+
+	cmds := []*Now{{}, {}}
+	err := ctx.DoConcurrent(cmds)
+	assert.Nil(t, err)
+	assert.Equal(t, []*Now{{Time: later}, {Time: later}}, cmds)
+
+	c := NowPlusHour{}
+	err = ctx.Do(&c)
+	assert.Nil(t, err)
+	assert.Equal(t, later.Add(time.Hour), c.Time)
+}
+
+func TestEffectsWithHandlerOnTestContext(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+	ctx.Cmd(func(cmd *Get) {
+		cmd.Body = "{...}"
+	})
+
+	scoped := effects.WithHandler(ctx, func(outer effects.Context, cmd *Now) error {
+		cmd.Time = later
+		return nil
+	})
+
+	n := Now{}
+	assert.Nil(t, scoped.Do(&n))
+	assert.Equal(t, later, n.Time)
+
+	g := Get{}
+	assert.Nil(t, scoped.Do(&g))
+	assert.Equal(t, "{...}", g.Body)
+	ctx.Finished(t)
+}
+
+func TestEffectsWithHandlerInvalidHandler(t *testing.T) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Errorf("The code did not panic")
+		} else {
+			assert.Equal(t, "effects.WithHandler(...) must receive a function like `func(effects.Context, *Cmd) error`, but received a `func(*effects_test.Now)`", r)
+		}
+	}()
+
+	effects.WithHandler(effects.NewContext(context.Background(), interpreter), func(cmd *Now) {})
+}
+
+func TestEffectsWithHandlerOuterSkipsMiddleware(t *testing.T) {
+	i := &chargeInterpreter{}
+	ctx := newIdempotentContext(i, effects.NewMemoryIdempotencyStore())
+
+	scoped := effects.WithHandler(ctx, func(outer effects.Context, cmd *ChargeCard) error {
+		cmd.Amount *= 2
+		return outer.Do(cmd)
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- scoped.Do(&ChargeCard{OrderID: "1", Amount: 100})
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the handler deadlocked on its own idempotency key")
+	}
+
+	// The result was recorded once, by the middleware around the handler
+	again := ChargeCard{OrderID: "1", Amount: 100}
+	assert.Nil(t, scoped.Do(&again))
+	assert.Equal(t, "ch_1", again.ChargeID)
+	assert.Equal(t, 200, again.Amount)
+	assert.Equal(t, int32(1), i.charges)
+}
+
+func TestEffectsWithHandlerInterceptsCallables(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	scoped := effects.WithHandler(ctx, func(outer effects.Context, cmd *NowPlusHour) error {
+		err := outer.Do(cmd)
+		cmd.Time = cmd.Time.Add(time.Minute)
+		return err
+	})
+
+	c := NowPlusHour{}
+	assert.Nil(t, scoped.Do(&c))
+	assert.Equal(t, now.Add(time.Hour+time.Minute), c.Time)
+
+	cmds := []*NowPlusHour{{}}
+	assert.Nil(t, scoped.DoSeries(cmds))
+	assert.Equal(t, now.Add(time.Hour+time.Minute), cmds[0].Time)
+}
+
+func TestEffectsWithHandlerOuterChecksOtherCommands(t *testing.T) {
+	policy := effects.NewPolicy()
+	policy.Allow(&DeleteAccount{}, isAdmin)
+	ctx := newPolicyContext(User{Name: "guest"}, policy)
+
+	account := DeleteAccount{ID: 1}
+	scoped := effects.WithHandler(ctx, func(outer effects.Context, cmd *Now) error {
+		err := outer.Do(&account)
+		if err != nil {
+			return err
+		}
+		return outer.Do(cmd)
+	})
+
+	err := scoped.Do(&Now{})
+	assert.Equal(t, effects.ErrForbidden, err)
+	assert.False(t, account.Deleted)
+
+	scoped = effects.WithHandler(ctx, func(outer effects.Context, cmd *Now) error {
+		return outer.Do(Now{})
+	})
+
+	err = scoped.Do(&Now{})
+	assert.Equal(t, "ctx.Do(...) must receive a ptr", err.Error())
+}
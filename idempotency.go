@@ -0,0 +1,178 @@
+package effects
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Idempotent is implemented by commands that must only run once per key,
+// e.g. a payment keyed by its order ID.
+type Idempotent interface {
+	IdempotencyKey() string
+}
+
+// IdempotencyStore records the results of completed idempotent commands.
+type IdempotencyStore interface {
+	Load(key string) (result []byte, found bool, err error)
+	Save(key string, result []byte) error
+}
+
+// Idempotency returns a Middleware that runs every Idempotent command at most
+// once per key.  After a command succeeds, its populated fields are saved to
+// store as JSON; later commands with the same key are populated from the
+// stored result instead of running.  A command with the same key as one that
+// is still running waits for it to finish.  Failed commands are not recorded,
+// so they can be retried.
+func Idempotency(store IdempotencyStore) Middleware {
+	mu := sync.Mutex{}
+	running := map[string]chan struct{}{}
+
+	acquire := func(ctx Context, key string) error {
+		for {
+			mu.Lock()
+			wait, busy := running[key]
+			if !busy {
+				running[key] = make(chan struct{})
+				mu.Unlock()
+				return nil
+			}
+			mu.Unlock()
+
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	release := func(key string) {
+		mu.Lock()
+		close(running[key])
+		delete(running, key)
+		mu.Unlock()
+	}
+
+	return func(next func(Context, interface{}) error) func(Context, interface{}) error {
+		return func(ctx Context, cmd interface{}) error {
+			idempotent, ok := cmd.(Idempotent)
+			if !ok || idempotent.IdempotencyKey() == "" {
+				return next(ctx, cmd)
+			}
+			key := idempotent.IdempotencyKey()
+
+			err := acquire(ctx, key)
+			if err != nil {
+				return err
+			}
+			defer release(key)
+
+			result, found, err := store.Load(key)
+			if err != nil {
+				return err
+			}
+			if found {
+				return json.Unmarshal(result, cmd)
+			}
+
+			err = next(ctx, cmd)
+			if err != nil {
+				return err
+			}
+
+			result, err = json.Marshal(cmd)
+			if err != nil {
+				return err
+			}
+			return store.Save(key, result)
+		}
+	}
+}
+
+type MemoryIdempotencyStore struct {
+	mu      sync.RWMutex
+	results map[string][]byte
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		results: map[string][]byte{},
+	}
+}
+
+func (s *MemoryIdempotencyStore) Load(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result, ok := s.results[key]
+	return result, ok, nil
+}
+
+func (s *MemoryIdempotencyStore) Save(key string, result []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[key] = result
+	return nil
+}
+
+// FileIdempotencyStore keeps one file per key in a directory, so results
+// survive restarts of the process.
+type FileIdempotencyStore struct {
+	Dir string
+}
+
+func NewFileIdempotencyStore(dir string) (*FileIdempotencyStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileIdempotencyStore{Dir: dir}, nil
+}
+
+func (s *FileIdempotencyStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *FileIdempotencyStore) Load(key string) ([]byte, bool, error) {
+	result, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+// Save writes the result to a temporary file and renames it into place so
+// that a crash never leaves a partial result behind.
+func (s *FileIdempotencyStore) Save(key string, result []byte) error {
+	return writeFileAtomic(s.path(key), result)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,136 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type ChargeCard struct {
+	OrderID  string
+	Amount   int
+	ChargeID string
+}
+
+func (c *ChargeCard) IdempotencyKey() string {
+	return "charge:" + c.OrderID
+}
+
+type chargeInterpreter struct {
+	charges int32
+	fail    bool
+	delay   time.Duration
+}
+
+func (i *chargeInterpreter) interpret(ctx effects.Context, command interface{}) error {
+	switch cmd := command.(type) {
+	case *ChargeCard:
+		time.Sleep(i.delay)
+		if i.fail {
+			return errors.New("card declined")
+		}
+		n := atomic.AddInt32(&i.charges, 1)
+		cmd.ChargeID = fmt.Sprintf("ch_%d", n)
+		return nil
+	}
+	return interpreter(ctx, command)
+}
+
+func newIdempotentContext(i *chargeInterpreter, store effects.IdempotencyStore) effects.Context {
+	return effects.RealContext{
+		Context:     context.Background(),
+		Interpreter: i.interpret,
+		Middleware:  []effects.Middleware{effects.Idempotency(store)},
+	}
+}
+
+func testIdempotency(t *testing.T, store effects.IdempotencyStore) {
+	i := &chargeInterpreter{}
+	ctx := newIdempotentContext(i, store)
+
+	first := ChargeCard{OrderID: "1", Amount: 100}
+	assert.Nil(t, ctx.Do(&first))
+	assert.Equal(t, "ch_1", first.ChargeID)
+
+	retry := ChargeCard{OrderID: "1", Amount: 100}
+	assert.Nil(t, ctx.Do(&retry))
+	assert.Equal(t, first, retry)
+
+	other := ChargeCard{OrderID: "2", Amount: 100}
+	assert.Nil(t, ctx.Do(&other))
+	assert.Equal(t, "ch_2", other.ChargeID)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&i.charges))
+
+	// commands without a key are not affected
+	n := Now{}
+	assert.Nil(t, ctx.Do(&n))
+	assert.Equal(t, now, n.Time)
+}
+
+func TestEffectsIdempotencyMemoryStore(t *testing.T) {
+	testIdempotency(t, effects.NewMemoryIdempotencyStore())
+}
+
+func TestEffectsIdempotencyFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "effects-idempotency")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := effects.NewFileIdempotencyStore(dir)
+	assert.Nil(t, err)
+	testIdempotency(t, store)
+
+	// results survive a new store on the same directory
+	reopened, err := effects.NewFileIdempotencyStore(dir)
+	assert.Nil(t, err)
+	i := &chargeInterpreter{}
+	cmd := ChargeCard{OrderID: "1"}
+	assert.Nil(t, newIdempotentContext(i, reopened).Do(&cmd))
+	assert.Equal(t, "ch_1", cmd.ChargeID)
+	assert.Equal(t, int32(0), i.charges)
+}
+
+func TestEffectsIdempotencyFailuresAreNotRecorded(t *testing.T) {
+	store := effects.NewMemoryIdempotencyStore()
+	i := &chargeInterpreter{fail: true}
+	ctx := newIdempotentContext(i, store)
+
+	err := ctx.Do(&ChargeCard{OrderID: "1"})
+	assert.Equal(t, "card declined", err.Error())
+
+	i.fail = false
+	cmd := ChargeCard{OrderID: "1"}
+	assert.Nil(t, ctx.Do(&cmd))
+	assert.Equal(t, "ch_1", cmd.ChargeID)
+}
+
+func TestEffectsIdempotencyConcurrentDuplicates(t *testing.T) {
+	i := &chargeInterpreter{delay: time.Millisecond * 20}
+	ctx := newIdempotentContext(i, effects.NewMemoryIdempotencyStore())
+
+	cmds := make([]*ChargeCard, 5)
+	wg := sync.WaitGroup{}
+	for n := range cmds {
+		cmds[n] = &ChargeCard{OrderID: "1"}
+		wg.Add(1)
+		go func(cmd *ChargeCard) {
+			defer wg.Done()
+			assert.Nil(t, ctx.Do(cmd))
+		}(cmds[n])
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&i.charges))
+	for _, cmd := range cmds {
+		assert.Equal(t, "ch_1", cmd.ChargeID)
+	}
+}
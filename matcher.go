@@ -0,0 +1,231 @@
+package effects
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Matcher decides whether a command fits an expectation registered with
+// ctx.Expect(...).
+type Matcher interface {
+	Matches(cmd interface{}) bool
+	String() string
+}
+
+// explainer is implemented by matchers that can describe why a command does
+// not match them, e.g. which of its fields differ.
+type explainer interface {
+	explain(cmd interface{}) []string
+}
+
+// typedMatcher is implemented by matchers that only match commands of one
+// type.
+type typedMatcher interface {
+	cmdType() reflect.Type
+}
+
+// Eq matches commands that are deeply equal to expected.  Pointers are
+// compared by the values they point to.
+func Eq(expected interface{}) Matcher {
+	return eqMatcher{expected: expected}
+}
+
+type eqMatcher struct {
+	expected interface{}
+}
+
+func (m eqMatcher) Matches(cmd interface{}) bool {
+	return reflect.DeepEqual(m.expected, cmd)
+}
+
+func (m eqMatcher) String() string {
+	return fmt.Sprintf("Eq(%#v)", m.expected)
+}
+
+func (m eqMatcher) cmdType() reflect.Type {
+	return reflect.TypeOf(m.expected)
+}
+
+func (m eqMatcher) explain(cmd interface{}) []string {
+	expected := indirect(reflect.ValueOf(m.expected))
+	actual := indirect(reflect.ValueOf(cmd))
+	if expected.Kind() != reflect.Struct || expected.Type() != actual.Type() {
+		return []string{fmt.Sprintf("expected %#v, got %#v", m.expected, cmd)}
+	}
+
+	var diffs []string
+	for i := 0; i < expected.NumField(); i++ {
+		field := expected.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		want := expected.Field(i).Interface()
+		got := actual.Field(i).Interface()
+		if !reflect.DeepEqual(want, got) {
+			diffs = append(diffs, fmt.Sprintf("%s: expected %#v, got %#v", field.Name, want, got))
+		}
+	}
+	return diffs
+}
+
+// Any matches every command.
+func Any() Matcher {
+	return anyMatcher{}
+}
+
+type anyMatcher struct{}
+
+func (anyMatcher) Matches(cmd interface{}) bool {
+	return true
+}
+
+func (anyMatcher) String() string {
+	return "Any()"
+}
+
+// FieldEq matches commands whose field name is deeply equal to value.
+func FieldEq(name string, value interface{}) Matcher {
+	return fieldEqMatcher{name: name, value: value}
+}
+
+type fieldEqMatcher struct {
+	name  string
+	value interface{}
+}
+
+func (m fieldEqMatcher) Matches(cmd interface{}) bool {
+	field, ok := fieldByName(cmd, m.name)
+	return ok && reflect.DeepEqual(field.Interface(), m.value)
+}
+
+func (m fieldEqMatcher) String() string {
+	return fmt.Sprintf("FieldEq(%q, %#v)", m.name, m.value)
+}
+
+func (m fieldEqMatcher) explain(cmd interface{}) []string {
+	field, ok := fieldByName(cmd, m.name)
+	if !ok {
+		return []string{fmt.Sprintf("%s: the command has no such field", m.name)}
+	}
+	return []string{fmt.Sprintf("%s: expected %#v, got %#v", m.name, m.value, field.Interface())}
+}
+
+// Regex matches commands whose string field name matches pattern.  It panics
+// if pattern does not compile.
+func Regex(name string, pattern string) Matcher {
+	return regexMatcher{name: name, re: regexp.MustCompile(pattern)}
+}
+
+type regexMatcher struct {
+	name string
+	re   *regexp.Regexp
+}
+
+func (m regexMatcher) Matches(cmd interface{}) bool {
+	field, ok := fieldByName(cmd, m.name)
+	return ok && field.Kind() == reflect.String && m.re.MatchString(field.String())
+}
+
+func (m regexMatcher) String() string {
+	return fmt.Sprintf("Regex(%q, %q)", m.name, m.re)
+}
+
+func (m regexMatcher) explain(cmd interface{}) []string {
+	field, ok := fieldByName(cmd, m.name)
+	if !ok || field.Kind() != reflect.String {
+		return []string{fmt.Sprintf("%s: the command has no such string field", m.name)}
+	}
+	return []string{fmt.Sprintf("%s: %q does not match /%s/", m.name, field.String(), m.re)}
+}
+
+// Not matches the commands that m does not match.
+func Not(m Matcher) Matcher {
+	return notMatcher{m: m}
+}
+
+type notMatcher struct {
+	m Matcher
+}
+
+func (m notMatcher) Matches(cmd interface{}) bool {
+	return !m.m.Matches(cmd)
+}
+
+func (m notMatcher) String() string {
+	return fmt.Sprintf("Not(%s)", m.m)
+}
+
+// Match matches the commands for which fn returns true.  fn is a function
+// such as
+//
+//	func(cmd *Get) bool
+//
+// and only commands of its argument's type match.
+func Match(fn interface{}) Matcher {
+	value := reflect.ValueOf(fn)
+	if value.Kind() != reflect.Func ||
+		value.Type().NumIn() != 1 ||
+		value.Type().NumOut() != 1 ||
+		value.Type().Out(0).Kind() != reflect.Bool {
+		panic(fmt.Sprintf("effects.Match(...) must receive a function like `func(*Cmd) bool`, but received a `%v`", reflect.TypeOf(fn)))
+	}
+	return funcMatcher{fn: value}
+}
+
+type funcMatcher struct {
+	fn reflect.Value
+}
+
+func (m funcMatcher) Matches(cmd interface{}) bool {
+	if reflect.TypeOf(cmd) != m.cmdType() {
+		return false
+	}
+	return m.fn.Call([]reflect.Value{reflect.ValueOf(cmd)})[0].Bool()
+}
+
+func (m funcMatcher) String() string {
+	return fmt.Sprintf("Match(%v)", m.fn.Type())
+}
+
+func (m funcMatcher) cmdType() reflect.Type {
+	return m.fn.Type().In(0)
+}
+
+// explain lists why cmd does not match m.
+func explain(m Matcher, cmd interface{}) []string {
+	if e, ok := m.(explainer); ok {
+		if lines := e.explain(cmd); len(lines) > 0 {
+			return lines
+		}
+	}
+	return []string{"does not match " + m.String()}
+}
+
+func matcherList(matchers []Matcher) string {
+	names := make([]string, len(matchers))
+	for i, m := range matchers {
+		names[i] = m.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+func fieldByName(cmd interface{}, name string) (reflect.Value, bool) {
+	v := indirect(reflect.ValueOf(cmd))
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	field, ok := v.Type().FieldByName(name)
+	if !ok || field.PkgPath != "" {
+		return reflect.Value{}, false
+	}
+	return v.FieldByIndex(field.Index), true
+}
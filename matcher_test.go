@@ -0,0 +1,152 @@
+package effects_test
+
+import (
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEffectsMatchers(t *testing.T) {
+	g := &Get{URL: "https://example.com/people/1", Body: "{}"}
+
+	assert.True(t, effects.Eq(&Get{URL: "https://example.com/people/1", Body: "{}"}).Matches(g))
+	assert.False(t, effects.Eq(&Get{URL: "https://example.com/people/1"}).Matches(g))
+	assert.False(t, effects.Eq(&Now{}).Matches(g))
+
+	assert.True(t, effects.Any().Matches(g))
+
+	assert.True(t, effects.FieldEq("Body", "{}").Matches(g))
+	assert.False(t, effects.FieldEq("Body", "[]").Matches(g))
+	assert.False(t, effects.FieldEq("Missing", "{}").Matches(g))
+
+	assert.True(t, effects.Regex("URL", `/people/\d+$`).Matches(g))
+	assert.False(t, effects.Regex("URL", `/planets/`).Matches(g))
+	assert.False(t, effects.Regex("Missing", `.*`).Matches(g))
+
+	assert.True(t, effects.Not(effects.FieldEq("Body", "[]")).Matches(g))
+	assert.False(t, effects.Not(effects.Any()).Matches(g))
+
+	long := effects.Match(func(cmd *Get) bool {
+		return len(cmd.URL) > 10
+	})
+	assert.True(t, long.Matches(g))
+	assert.False(t, long.Matches(&Get{URL: "/"}))
+	assert.False(t, long.Matches(&Now{}))
+}
+
+func TestEffectsMatchPanicsOnInvalidFunction(t *testing.T) {
+	assert.PanicsWithValue(t, "effects.Match(...) must receive a function like `func(*Cmd) bool`, but received a `func(*effects_test.Get) error`", func() {
+		effects.Match(func(cmd *Get) error { return nil })
+	})
+}
+
+func TestEffectsExpect(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Expect(&Now{})
+	ctx.Expect(effects.FieldEq("URL", "https://www.swapi.co/api/people/1"))
+	ctx.Expect(effects.Match(func(cmds []*Now) bool {
+		return len(cmds) == 3
+	}))
+	ctx.Expect(effects.Any())
+
+	body, err := testRunnerFn(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "", body)
+	ctx.Finished(t)
+}
+
+func TestEffectsExpectInAnyOrder(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.Unordered())
+
+	ctx.Expect(&Get{URL: "/b"})
+	ctx.Expect(&Get{URL: "/a"})
+	ctx.Expect(effects.Not(effects.Regex("URL", "^/[ab]$")))
+
+	assert.Nil(t, ctx.Do(&Get{URL: "/c"}))
+	assert.Nil(t, ctx.Do(&Get{URL: "/a"}))
+	assert.Nil(t, ctx.Do(&Get{URL: "/b"}))
+	ctx.Finished(t)
+}
+
+func TestEffectsExpectMismatchShowsFields(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
+		ctx.Expect(&Get{URL: "/a", Body: "x"})
+
+		ctx.Do(&Get{URL: "/b", Body: "x"})
+	})
+	assert.Contains(t, output, `command number 1 in your function does not match matcher_test.go:76: ctx.Expect(Eq(&effects_test.Get{URL:"/a", Body:"x"})):`)
+	assert.Contains(t, output, `URL: expected "/a", got "/b"`)
+	assert.NotContains(t, output, "Body: expected")
+}
+
+func TestEffectsExpectMismatchedType(t *testing.T) {
+	output := expectFatal(t, func(t *testing.T) {
+		ctx := effects.NewTestContext(t)
+		ctx.Expect(effects.Regex("URL", "^/a$"), &Get{URL: "/a"})
+
+		ctx.Do(&Now{})
+	})
+	assert.Contains(t, output, "expected a command of type *effects_test.Get, got *effects_test.Now")
+}
+
+func TestEffectsExpectReturns(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Expect(&Now{}).Returns(Now{Time: now})
+	ctx.Expect(&Get{URL: "https://www.swapi.co/api/people/1"}).Returns(&Get{Body: "{...}"})
+	ctx.Expect(effects.Any())
+	ctx.Expect(effects.Any())
+
+	body, err := testRunnerFn(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "{...}", body)
+	ctx.Finished(t)
+}
+
+func TestEffectsExpectSetFields(t *testing.T) {
+	type result struct {
+		Body string
+	}
+
+	ctx := effects.NewTestContext(t)
+	ctx.Expect(effects.FieldEq("URL", "/a")).SetFields(map[string]interface{}{"Body": "a"})
+	ctx.Expect(effects.FieldEq("URL", "/b")).SetFields(result{Body: "b"})
+	ctx.Cmd(func(cmd *Get) {
+		cmd.URL = "/d"
+	}).SetFields(map[string]string{"Body": "c"})
+
+	for _, tc := range []struct{ url, body string }{{"/a", "a"}, {"/b", "b"}, {"/c", "c"}} {
+		g := Get{URL: tc.url}
+		assert.Nil(t, ctx.Do(&g))
+		assert.Equal(t, tc.body, g.Body)
+	}
+	ctx.Finished(t)
+}
+
+func TestEffectsExpectFails(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+	ctx.Expect(&Get{URL: "/a"}).Returns(Get{Body: "partial"}).Fails(errors.New("oops"))
+
+	g := Get{URL: "/a"}
+	err := ctx.Do(&g)
+	assert.Equal(t, "oops", err.Error())
+	assert.Equal(t, "partial", g.Body)
+	ctx.Finished(t)
+}
+
+func TestEffectsExpectReturnsChecksTypes(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
+
+	assert.PanicsWithValue(t, "ctx.Expect(Eq(&effects_test.Get{URL:\"\", Body:\"\"})).Returns(...) must receive a `*effects_test.Get`, but received a `effects_test.Now`", func() {
+		ctx.Expect(&Get{}).Returns(Now{Time: now})
+	})
+	assert.PanicsWithValue(t, "ctx.Cmd(...) cannot set Missing: effects_test.Get has no such exported field", func() {
+		ctx.Cmd(func(cmd *Get) {}).SetFields(map[string]interface{}{"Missing": 1})
+	})
+	assert.PanicsWithValue(t, "ctx.Cmd(...) cannot set Body: a `int` cannot be assigned to a field of type `string`", func() {
+		ctx.Cmd(func(cmd *Get) {}).SetFields(map[string]interface{}{"Body": 1})
+	})
+}
@@ -0,0 +1,395 @@
+package effects
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// OutboxMessage is a command recorded in an outbox, waiting to be dispatched.
+type OutboxMessage struct {
+	ID          string
+	Envelope    Envelope
+	CreatedAt   time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+// OutboxStore persists outbox messages for a Relay.  Messages are added
+// through an OutboxTx.
+type OutboxStore interface {
+	// Pending returns up to limit messages whose NextAttempt is not after now,
+	// oldest first.
+	Pending(now time.Time, limit int) ([]OutboxMessage, error)
+	// Update replaces a message after a failed attempt.
+	Update(message OutboxMessage) error
+	Delete(id string) error
+}
+
+// OutboxTx appends messages to an outbox as part of the caller's database
+// transaction, so that they are committed or rolled back together with the
+// caller's other writes.  Stores usually provide one bound to a transaction
+// of their database.
+type OutboxTx interface {
+	Append(messages []OutboxMessage) error
+}
+
+// DeadLetterStore receives the outbox messages that could not be dispatched.
+type DeadLetterStore interface {
+	Add(message OutboxMessage) error
+}
+
+// Outbox records commands of selected types instead of running them while
+// inside a Transaction.  A Relay dispatches them later.
+type Outbox struct {
+	Registry *TypeRegistry
+	Store    OutboxStore
+
+	types map[reflect.Type]bool
+}
+
+// NewOutbox returns an Outbox for commands of the same types as cmds, which
+// must be registered with registry.
+func NewOutbox(registry *TypeRegistry, store OutboxStore, cmds ...interface{}) *Outbox {
+	types := map[reflect.Type]bool{}
+	for _, cmd := range cmds {
+		types[reflect.TypeOf(cmd)] = true
+	}
+	return &Outbox{
+		Registry: registry,
+		Store:    store,
+		types:    types,
+	}
+}
+
+// Transaction calls fn with a child of ctx in which commands of the outbox's
+// types are serialized and appended to tx instead of run.  tx belongs to the
+// caller's database transaction, which fn writes to as well; the caller
+// commits it if Transaction succeeds and rolls it back otherwise, e.g.
+//
+//	sqlTx, _ := db.Begin()
+//	err := outbox.Transaction(ctx, store.WithTx(sqlTx), func(ctx effects.Context) error {
+//		// write the order with sqlTx, then
+//		return ctx.Do(&OrderCreated{ID: id})
+//	})
+//	if err != nil {
+//		sqlTx.Rollback()
+//		return err
+//	}
+//	return sqlTx.Commit()
+//
+// Recording only applies to a RealContext; other Context implementations are
+// passed to fn unchanged.
+func (o *Outbox) Transaction(ctx Context, tx OutboxTx, fn func(Context) error) error {
+	realCtx, ok := ctx.(RealContext)
+	if !ok {
+		return fn(ctx)
+	}
+
+	realCtx.Middleware = append([]Middleware{o.record(tx)}, realCtx.Middleware...)
+	return fn(realCtx)
+}
+
+func (o *Outbox) record(tx OutboxTx) Middleware {
+	// Database transactions are not safe for concurrent use, e.g. by the
+	// commands of a Parallel
+	mu := sync.Mutex{}
+
+	return func(next func(Context, interface{}) error) func(Context, interface{}) error {
+		return func(ctx Context, cmd interface{}) error {
+			if !o.types[reflect.TypeOf(cmd)] {
+				return next(ctx, cmd)
+			}
+
+			env, err := o.Registry.Envelope(cmd)
+			if err != nil {
+				return err
+			}
+
+			id, err := newID()
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+			mu.Lock()
+			defer mu.Unlock()
+			return tx.Append([]OutboxMessage{{
+				ID:          id,
+				Envelope:    env,
+				CreatedAt:   now,
+				NextAttempt: now,
+			}})
+		}
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Relay dispatches the messages of an outbox through a copy of Context, the
+// context holding the real interpreter and middleware, bound to the context
+// passed to Run or RunOnce.  Messages are deleted only
+// after they were dispatched successfully, so delivery is at least once.  A
+// message that fails MaxAttempts times, or that cannot be decoded, is moved
+// to DeadLetter.  Without a DeadLetter store it stays in the outbox and is
+// retried after its backoff, so that it does not hold up the other messages.
+type Relay struct {
+	Outbox     *Outbox
+	Context    RealContext
+	DeadLetter DeadLetterStore
+
+	// MaxAttempts defaults to 5.
+	MaxAttempts int
+	// Backoff returns the delay before the next attempt after attempt
+	// failures.  It defaults to ExponentialBackoff.
+	Backoff func(attempt int) time.Duration
+	// BatchSize defaults to 100.
+	BatchSize int
+	// PollInterval defaults to 1s.
+	PollInterval time.Duration
+}
+
+func (r *Relay) maxAttempts() int {
+	if r.MaxAttempts <= 0 {
+		return 5
+	}
+	return r.MaxAttempts
+}
+
+// RunOnce dispatches the messages that are due and returns how many were
+// delivered.  It stops early with ctx.Err() when ctx ends.
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	batchSize := r.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	messages, err := r.Outbox.Store.Pending(time.Now(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	effectsCtx := r.Context
+	effectsCtx.Context = ctx
+
+	delivered := 0
+	for _, message := range messages {
+		if ctx.Err() != nil {
+			return delivered, ctx.Err()
+		}
+
+		ok, err := r.dispatch(effectsCtx, message)
+		if err != nil {
+			return delivered, err
+		}
+		if ok {
+			delivered++
+		}
+	}
+
+	return delivered, nil
+}
+
+// dispatch runs the command held by message and reports whether it succeeded.
+func (r *Relay) dispatch(ctx RealContext, message OutboxMessage) (bool, error) {
+	cmd, err := r.Outbox.Registry.Open(message.Envelope)
+	if err != nil {
+		message.Attempts++
+		message.LastError = err.Error()
+		return false, r.deadLetter(message)
+	}
+
+	err = ctx.Do(cmd)
+	if err == nil {
+		return true, r.Outbox.Store.Delete(message.ID)
+	}
+
+	// The relay is stopping; the message is retried by the next run without
+	// counting the interrupted attempt
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	message.Attempts++
+	message.LastError = err.Error()
+	if message.Attempts >= r.maxAttempts() {
+		return false, r.deadLetter(message)
+	}
+
+	message.NextAttempt = time.Now().Add(backoff(r.Backoff, message.Attempts))
+	return false, r.Outbox.Store.Update(message)
+}
+
+func (r *Relay) deadLetter(message OutboxMessage) error {
+	if r.DeadLetter == nil {
+		message.NextAttempt = time.Now().Add(backoff(r.Backoff, message.Attempts))
+		return r.Outbox.Store.Update(message)
+	}
+	err := r.DeadLetter.Add(message)
+	if err != nil {
+		return err
+	}
+	return r.Outbox.Store.Delete(message.ID)
+}
+
+// Run calls RunOnce every PollInterval until ctx ends.
+func (r *Relay) Run(ctx context.Context) error {
+	interval := r.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := r.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type MemoryOutboxStore struct {
+	mu       sync.Mutex
+	messages []OutboxMessage
+}
+
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{}
+}
+
+// Begin starts a transaction whose messages are added to the store when it
+// is committed.
+func (s *MemoryOutboxStore) Begin() *MemoryOutboxTx {
+	return &MemoryOutboxTx{store: s}
+}
+
+func (s *MemoryOutboxStore) append(messages []OutboxMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, messages...)
+}
+
+func (s *MemoryOutboxStore) Pending(now time.Time, limit int) ([]OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pending []OutboxMessage
+	for _, message := range s.messages {
+		if len(pending) == limit {
+			break
+		}
+		if !message.NextAttempt.After(now) {
+			pending = append(pending, message)
+		}
+	}
+	return pending, nil
+}
+
+func (s *MemoryOutboxStore) Update(message OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.messages {
+		if s.messages[i].ID == message.ID {
+			s.messages[i] = message
+			return nil
+		}
+	}
+	return fmt.Errorf("outbox message %s does not exist", message.ID)
+}
+
+func (s *MemoryOutboxStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.messages {
+		if s.messages[i].ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Messages returns the messages in the outbox in the order they were
+// appended.
+func (s *MemoryOutboxStore) Messages() []OutboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]OutboxMessage{}, s.messages...)
+}
+
+// MemoryOutboxTx is a transaction of a MemoryOutboxStore.
+type MemoryOutboxTx struct {
+	store *MemoryOutboxStore
+
+	mu       sync.Mutex
+	messages []OutboxMessage
+	done     bool
+}
+
+func (tx *MemoryOutboxTx) Append(messages []OutboxMessage) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return errors.New("the outbox transaction has already been committed or rolled back")
+	}
+	tx.messages = append(tx.messages, messages...)
+	return nil
+}
+
+func (tx *MemoryOutboxTx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return errors.New("the outbox transaction has already been committed or rolled back")
+	}
+	tx.done = true
+	tx.store.append(tx.messages)
+	return nil
+}
+
+func (tx *MemoryOutboxTx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.done = true
+	tx.messages = nil
+	return nil
+}
+
+type MemoryDeadLetterStore struct {
+	mu       sync.Mutex
+	messages []OutboxMessage
+}
+
+func (s *MemoryDeadLetterStore) Add(message OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) Messages() []OutboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]OutboxMessage{}, s.messages...)
+}
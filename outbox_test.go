@@ -0,0 +1,303 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type SaveOrder struct {
+	ID string
+}
+
+type PublishEvent struct {
+	Name string
+}
+
+type publisher struct {
+	published []string
+	failures  int
+	block     bool
+}
+
+func (p *publisher) interpret(ctx effects.Context, command interface{}) error {
+	switch cmd := command.(type) {
+	case *SaveOrder:
+		return nil
+	case *PublishEvent:
+		if p.block {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		if p.failures > 0 {
+			p.failures--
+			return errors.New("broker unavailable")
+		}
+		p.published = append(p.published, cmd.Name)
+		return nil
+	}
+	return interpreter(ctx, command)
+}
+
+func newPublisherContext(p *publisher) effects.RealContext {
+	return effects.RealContext{
+		Context:     context.Background(),
+		Interpreter: p.interpret,
+	}
+}
+
+func newOutbox() (*effects.Outbox, *effects.MemoryOutboxStore) {
+	registry := effects.NewTypeRegistry()
+	registry.MustRegister("effects_test.PublishEvent", &PublishEvent{})
+	store := effects.NewMemoryOutboxStore()
+	return effects.NewOutbox(registry, store, &PublishEvent{}), store
+}
+
+// transaction runs fn in an outbox transaction and commits or rolls back the
+// store's transaction as a caller would.
+func transaction(outbox *effects.Outbox, store *effects.MemoryOutboxStore, ctx effects.Context, fn func(effects.Context) error) error {
+	tx := store.Begin()
+	err := outbox.Transaction(ctx, tx, fn)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func TestEffectsOutboxTransaction(t *testing.T) {
+	outbox, store := newOutbox()
+	p := &publisher{}
+	ctx := newPublisherContext(p)
+
+	err := transaction(outbox, store, ctx, func(ctx effects.Context) error {
+		err := ctx.Do(&SaveOrder{ID: "1"})
+		if err != nil {
+			return err
+		}
+		return ctx.Do(&effects.Sequence{&PublishEvent{Name: "order.created"}, &PublishEvent{Name: "order.paid"}})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(p.published))
+
+	messages := store.Messages()
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "effects_test.PublishEvent", messages[0].Envelope.Type)
+	assert.JSONEq(t, `{"Name":"order.created"}`, string(messages[0].Envelope.Payload))
+
+	// outside of a transaction commands run straight away
+	err = ctx.Do(&PublishEvent{Name: "direct"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"direct"}, p.published)
+
+	relay := effects.Relay{
+		Outbox:  outbox,
+		Context: ctx,
+	}
+	delivered, err := relay.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, delivered)
+	assert.Equal(t, []string{"direct", "order.created", "order.paid"}, p.published)
+	assert.Equal(t, 0, len(store.Messages()))
+}
+
+func TestEffectsOutboxTransactionFailureDiscardsMessages(t *testing.T) {
+	outbox, store := newOutbox()
+	ctx := newPublisherContext(&publisher{})
+
+	err := transaction(outbox, store, ctx, func(ctx effects.Context) error {
+		err := ctx.Do(&PublishEvent{Name: "order.created"})
+		if err != nil {
+			return err
+		}
+		return ctx.Do(&ErrorOut{})
+	})
+	assert.Equal(t, "oops", err.Error())
+	assert.Equal(t, 0, len(store.Messages()))
+}
+
+func TestEffectsOutboxTransactionIsPartOfTheCallersTransaction(t *testing.T) {
+	outbox, store := newOutbox()
+	ctx := newPublisherContext(&publisher{})
+
+	tx := store.Begin()
+	err := outbox.Transaction(ctx, tx, func(ctx effects.Context) error {
+		return ctx.Do(&PublishEvent{Name: "order.created"})
+	})
+	assert.Nil(t, err)
+
+	// nothing is visible to the relay until the caller commits
+	assert.Equal(t, 0, len(store.Messages()))
+
+	// e.g. the caller's own writes failed to commit
+	assert.Nil(t, tx.Rollback())
+	assert.Equal(t, 0, len(store.Messages()))
+	assert.NotNil(t, tx.Commit())
+
+	tx = store.Begin()
+	err = outbox.Transaction(ctx, tx, func(ctx effects.Context) error {
+		return ctx.Do(&effects.Parallel{&PublishEvent{Name: "a"}, &PublishEvent{Name: "b"}})
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+	assert.Equal(t, 2, len(store.Messages()))
+}
+
+func TestEffectsOutboxRelayRetriesAndDeadLetters(t *testing.T) {
+	outbox, store := newOutbox()
+	p := &publisher{failures: 4}
+	ctx := newPublisherContext(p)
+	deadLetter := &effects.MemoryDeadLetterStore{}
+
+	err := transaction(outbox, store, ctx, func(ctx effects.Context) error {
+		return ctx.DoSeries([]*PublishEvent{{Name: "a"}, {Name: "b"}})
+	})
+	assert.Nil(t, err)
+
+	relay := effects.Relay{
+		Outbox:      outbox,
+		Context:     ctx,
+		DeadLetter:  deadLetter,
+		MaxAttempts: 2,
+		Backoff: func(attempt int) time.Duration {
+			return 0
+		},
+	}
+
+	// both fail once
+	delivered, err := relay.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 1, store.Messages()[0].Attempts)
+	assert.Equal(t, "broker unavailable", store.Messages()[0].LastError)
+
+	// both fail a second time and are dead lettered
+	delivered, err = relay.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 0, len(store.Messages()))
+	assert.Equal(t, 2, len(deadLetter.Messages()))
+	assert.Equal(t, 2, deadLetter.Messages()[0].Attempts)
+}
+
+func TestEffectsOutboxRelayWithoutDeadLetterStore(t *testing.T) {
+	outbox, store := newOutbox()
+	p := &publisher{failures: 1}
+	ctx := newPublisherContext(p)
+
+	err := transaction(outbox, store, ctx, func(ctx effects.Context) error {
+		return ctx.DoSeries([]*PublishEvent{{Name: "a"}, {Name: "b"}})
+	})
+	assert.Nil(t, err)
+
+	relay := effects.Relay{
+		Outbox:      outbox,
+		Context:     ctx,
+		MaxAttempts: 1,
+		Backoff: func(attempt int) time.Duration {
+			return time.Hour
+		},
+	}
+
+	// the failing message is kept for later and the next one is delivered
+	delivered, err := relay.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, []string{"b"}, p.published)
+	assert.Equal(t, 1, len(store.Messages()))
+	assert.Equal(t, 1, store.Messages()[0].Attempts)
+	assert.True(t, store.Messages()[0].NextAttempt.After(time.Now().Add(time.Minute*59)))
+}
+
+func TestEffectsOutboxRelayBackoff(t *testing.T) {
+	outbox, store := newOutbox()
+	p := &publisher{failures: 1}
+	ctx := newPublisherContext(p)
+
+	err := transaction(outbox, store, ctx, func(ctx effects.Context) error {
+		return ctx.Do(&PublishEvent{Name: "a"})
+	})
+	assert.Nil(t, err)
+
+	relay := effects.Relay{
+		Outbox:  outbox,
+		Context: ctx,
+		Backoff: func(attempt int) time.Duration {
+			return time.Hour
+		},
+	}
+
+	_, err = relay.RunOnce(context.Background())
+	assert.Nil(t, err)
+
+	// the message is not due again yet
+	delivered, err := relay.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 1, len(store.Messages()))
+	assert.True(t, store.Messages()[0].NextAttempt.After(time.Now().Add(time.Minute*59)))
+}
+
+func TestEffectsOutboxRelayRun(t *testing.T) {
+	outbox, store := newOutbox()
+	p := &publisher{}
+	ctx := newPublisherContext(p)
+
+	err := transaction(outbox, store, ctx, func(ctx effects.Context) error {
+		return ctx.Do(&PublishEvent{Name: "a"})
+	})
+	assert.Nil(t, err)
+
+	relay := effects.Relay{
+		Outbox:       outbox,
+		Context:      ctx,
+		PollInterval: time.Millisecond,
+	}
+
+	runCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err = relay.Run(runCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, len(store.Messages()))
+	assert.Equal(t, []string{"a"}, p.published)
+}
+
+func TestEffectsOutboxRelayRunCancelsInFlightCommands(t *testing.T) {
+	outbox, store := newOutbox()
+	p := &publisher{block: true}
+	ctx := newPublisherContext(p)
+
+	err := transaction(outbox, store, ctx, func(ctx effects.Context) error {
+		return ctx.DoSeries([]*PublishEvent{{Name: "a"}, {Name: "b"}})
+	})
+	assert.Nil(t, err)
+
+	relay := effects.Relay{
+		Outbox:       outbox,
+		Context:      ctx,
+		PollInterval: time.Millisecond,
+	}
+
+	runCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- relay.Run(runCtx)
+	}()
+
+	select {
+	case err = <-done:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(time.Second):
+		t.Fatal("the relay did not stop when its context ended")
+	}
+
+	// the interrupted messages are kept for the next run
+	assert.Equal(t, 2, len(store.Messages()))
+	assert.Equal(t, 0, store.Messages()[0].Attempts)
+	assert.Equal(t, 0, store.Messages()[1].Attempts)
+}
@@ -0,0 +1,112 @@
+package effects
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal that issues
+// commands.  Pass the result to NewContext.
+func WithPrincipal(ctx context.Context, principal interface{}) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns the principal stored with WithPrincipal, or nil.
+func Principal(ctx Context) interface{} {
+	return ctx.Value(principalKey{})
+}
+
+// Rule reports whether it matches the principal issuing cmd.
+type Rule func(principal interface{}, cmd interface{}) bool
+
+type AuditEvent struct {
+	Time      time.Time
+	Principal interface{}
+	Cmd       interface{}
+	Reason    string
+}
+
+// Policy holds allow and deny rules per command type.  Commands without any
+// rules are allowed.  A command is forbidden if a deny rule matches, or if
+// allow rules are registered for its type and none of them match.
+type Policy struct {
+	Audit func(AuditEvent)
+
+	mu    sync.RWMutex
+	allow map[reflect.Type][]Rule
+	deny  map[reflect.Type][]Rule
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		allow: map[reflect.Type][]Rule{},
+		deny:  map[reflect.Type][]Rule{},
+	}
+}
+
+// Allow registers rule for the type of cmd, e.g. p.Allow(&DeleteAccount{}, isAdmin).
+func (p *Policy) Allow(cmd interface{}, rule Rule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := reflect.TypeOf(cmd)
+	p.allow[t] = append(p.allow[t], rule)
+}
+
+// Deny registers rule for the type of cmd.  Deny rules take precedence over
+// allow rules.
+func (p *Policy) Deny(cmd interface{}, rule Rule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := reflect.TypeOf(cmd)
+	p.deny[t] = append(p.deny[t], rule)
+}
+
+// Authorize returns ErrForbidden if the principal on ctx may not issue cmd.
+func (p *Policy) Authorize(ctx Context, cmd interface{}) error {
+	principal := Principal(ctx)
+	t := reflect.TypeOf(cmd)
+
+	p.mu.RLock()
+	allow := p.allow[t]
+	deny := p.deny[t]
+	p.mu.RUnlock()
+
+	for _, rule := range deny {
+		if rule(principal, cmd) {
+			p.audit(principal, cmd, "matched a deny rule")
+			return ErrForbidden
+		}
+	}
+
+	if len(allow) == 0 {
+		return nil
+	}
+
+	for _, rule := range allow {
+		if rule(principal, cmd) {
+			return nil
+		}
+	}
+
+	p.audit(principal, cmd, "did not match any allow rule")
+	return ErrForbidden
+}
+
+func (p *Policy) audit(principal interface{}, cmd interface{}, reason string) {
+	if p.Audit == nil {
+		return
+	}
+	p.Audit(AuditEvent{
+		Time:      time.Now(),
+		Principal: principal,
+		Cmd:       cmd,
+		Reason:    reason,
+	})
+}
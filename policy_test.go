@@ -0,0 +1,112 @@
+package effects_test
+
+import (
+	"context"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type DeleteAccount struct {
+	ID      int
+	Deleted bool
+}
+
+type User struct {
+	Name  string
+	Admin bool
+}
+
+func isAdmin(principal interface{}, cmd interface{}) bool {
+	user, ok := principal.(User)
+	return ok && user.Admin
+}
+
+func policyInterpreter(ctx effects.Context, command interface{}) error {
+	switch cmd := command.(type) {
+	case *DeleteAccount:
+		cmd.Deleted = true
+	case *Now:
+		cmd.Time = now
+	}
+	return nil
+}
+
+func newPolicyContext(principal interface{}, policy *effects.Policy) effects.Context {
+	return effects.RealContext{
+		Context:     effects.WithPrincipal(context.Background(), principal),
+		Interpreter: policyInterpreter,
+		Policy:      policy,
+	}
+}
+
+func TestEffectsPolicyAllow(t *testing.T) {
+	var events []effects.AuditEvent
+	policy := effects.NewPolicy()
+	policy.Audit = func(e effects.AuditEvent) {
+		events = append(events, e)
+	}
+	policy.Allow(&DeleteAccount{}, isAdmin)
+
+	admin := User{Name: "root", Admin: true}
+	ctx := newPolicyContext(admin, policy)
+	cmd := DeleteAccount{ID: 1}
+	err := ctx.Do(&cmd)
+	assert.Nil(t, err)
+	assert.True(t, cmd.Deleted)
+	assert.Equal(t, admin, effects.Principal(ctx))
+
+	guest := User{Name: "guest"}
+	ctx = newPolicyContext(guest, policy)
+	cmd = DeleteAccount{ID: 1}
+	err = ctx.Do(&cmd)
+	assert.Equal(t, effects.ErrForbidden, err)
+	assert.False(t, cmd.Deleted)
+
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, guest, events[0].Principal)
+	assert.Equal(t, &cmd, events[0].Cmd)
+	assert.Equal(t, "did not match any allow rule", events[0].Reason)
+}
+
+func TestEffectsPolicyDenyTakesPrecedence(t *testing.T) {
+	var events []effects.AuditEvent
+	policy := effects.NewPolicy()
+	policy.Audit = func(e effects.AuditEvent) {
+		events = append(events, e)
+	}
+	policy.Allow(&DeleteAccount{}, isAdmin)
+	policy.Deny(&DeleteAccount{}, func(principal interface{}, cmd interface{}) bool {
+		return cmd.(*DeleteAccount).ID == 0
+	})
+
+	ctx := newPolicyContext(User{Admin: true}, policy)
+	err := ctx.Do(&DeleteAccount{ID: 0})
+	assert.Equal(t, effects.ErrForbidden, err)
+	assert.Equal(t, "matched a deny rule", events[0].Reason)
+}
+
+func TestEffectsPolicyUnruledCommandsAreAllowed(t *testing.T) {
+	policy := effects.NewPolicy()
+	policy.Allow(&DeleteAccount{}, isAdmin)
+
+	ctx := newPolicyContext(nil, policy)
+	n := Now{}
+	err := ctx.Do(&n)
+	assert.Nil(t, err)
+	assert.Equal(t, now, n.Time)
+}
+
+func TestEffectsPolicyRulePanics(t *testing.T) {
+	policy := effects.NewPolicy()
+	policy.Allow(&DeleteAccount{}, func(principal interface{}, cmd interface{}) bool {
+		return principal.(User).Admin
+	})
+	ctx := newPolicyContext(nil, policy)
+
+	err := ctx.Do(&DeleteAccount{ID: 1})
+	assert.IsType(t, effects.InterpreterError{}, err)
+
+	err = ctx.DoConcurrent([]*DeleteAccount{{ID: 1}, {ID: 2}})
+	assert.IsType(t, effects.InterpreterError{}, err)
+}
@@ -0,0 +1,379 @@
+package effects
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// EnqueueOptions control how a command passed to Enqueue is executed.
+type EnqueueOptions struct {
+	// Delay postpones the first attempt.
+	Delay time.Duration
+	// MaxAttempts defaults to 5.
+	MaxAttempts int
+}
+
+// Job is a command waiting in a JobQueue.
+type Job struct {
+	ID          string
+	Envelope    Envelope
+	Attempts    int
+	MaxAttempts int
+	// VisibleAt is the time from which the job may be reserved: when it is
+	// due, or when the reservation of the worker running it expires.
+	VisibleAt time.Time
+	LastError string
+}
+
+// JobQueue stores jobs for Workers.
+type JobQueue interface {
+	Push(job Job) error
+	// Reserve returns a job whose VisibleAt is not after now and hides it
+	// from other workers for the visibility timeout.
+	Reserve(now time.Time, visibility time.Duration) (Job, bool, error)
+	// Ack removes a finished job.
+	Ack(id string) error
+	// Retry stores job, with its updated attempts and error, to be visible
+	// again at runAt.
+	Retry(job Job, runAt time.Time) error
+}
+
+// Enqueue serializes cmd with ctx.Registry and pushes it onto ctx.Queue to be
+// run by a Worker.  cmd is validated and authorized before it is enqueued.
+func (ctx RealContext) Enqueue(cmd interface{}, opts EnqueueOptions) error {
+	err := ctx.prepare("Enqueue", cmd)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Queue == nil || ctx.Registry == nil {
+		return errors.New("ctx.Enqueue(...) requires a RealContext with a Queue and a Registry")
+	}
+
+	env, err := ctx.Registry.Envelope(cmd)
+	if err != nil {
+		return err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	return ctx.Queue.Push(Job{
+		ID:          id,
+		Envelope:    env,
+		MaxAttempts: maxAttempts,
+		VisibleAt:   time.Now().Add(opts.Delay),
+	})
+}
+
+// Worker runs the jobs of Context.Queue.  Each job is decoded with
+// Context.Registry and runs through a copy of Context, so it uses the same
+// interpreter, middleware and policy as inline commands.
+type Worker struct {
+	Context RealContext
+
+	// Concurrency is the number of jobs run at once and defaults to 1.
+	Concurrency int
+	// VisibilityTimeout bounds how long a job may run before another worker
+	// may pick it up again.  It defaults to 30s.
+	VisibilityTimeout time.Duration
+	// PollInterval is how long to wait when the queue is empty and defaults
+	// to 1s.
+	PollInterval time.Duration
+	// Backoff returns the delay before the next attempt after attempt
+	// failures.  It defaults to ExponentialBackoff.
+	Backoff func(attempt int) time.Duration
+	// OnFailure, if set, is called for jobs that failed their last attempt.
+	OnFailure func(job Job, err error)
+}
+
+// Run runs jobs until ctx ends and then returns ctx.Err().
+func (w *Worker) Run(ctx context.Context) error {
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	interval := w.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	errs := make(chan error, concurrency)
+	child, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				ran, err := w.RunOnce(child)
+				if child.Err() != nil {
+					return
+				}
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				if ran {
+					continue
+				}
+
+				select {
+				case <-child.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		if ctx.Err() == nil {
+			return err
+		}
+	default:
+	}
+	return ctx.Err()
+}
+
+// RunOnce reserves and runs a single job.  It reports whether a job was
+// available.  The error is only set when the queue fails or ctx has already
+// ended; failing jobs are retried or handed to OnFailure.
+func (w *Worker) RunOnce(ctx context.Context) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	visibility := w.VisibilityTimeout
+	if visibility <= 0 {
+		visibility = time.Second * 30
+	}
+
+	job, ok, err := w.Context.Queue.Reserve(time.Now(), visibility)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, visibility)
+	defer cancel()
+
+	err = w.run(jobCtx, job)
+	if err == nil {
+		return true, w.Context.Queue.Ack(job.ID)
+	}
+
+	// The worker is stopping; the job becomes visible again once its
+	// reservation expires.
+	if ctx.Err() != nil {
+		return true, nil
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= job.MaxAttempts {
+		if w.OnFailure != nil {
+			w.OnFailure(job, err)
+		}
+		return true, w.Context.Queue.Ack(job.ID)
+	}
+
+	return true, w.Context.Queue.Retry(job, time.Now().Add(backoff(w.Backoff, job.Attempts)))
+}
+
+func (w *Worker) run(ctx context.Context, job Job) error {
+	cmd, err := w.Context.Registry.Open(job.Envelope)
+	if err != nil {
+		return err
+	}
+
+	effectsCtx := w.Context
+	effectsCtx.Context = ctx
+	return effectsCtx.Do(cmd)
+}
+
+// MaxBackoff is the longest delay returned by ExponentialBackoff.
+const MaxBackoff = time.Hour
+
+// ExponentialBackoff waits 1s after the first failed attempt and doubles the
+// delay with every further attempt, up to MaxBackoff.
+func ExponentialBackoff(attempt int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempt && delay < MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxBackoff {
+		return MaxBackoff
+	}
+	return delay
+}
+
+// backoff returns the delay before the next attempt with fn, or with
+// ExponentialBackoff if fn is nil.
+func backoff(fn func(attempt int) time.Duration, attempt int) time.Duration {
+	if fn != nil {
+		return fn(attempt)
+	}
+	return ExponentialBackoff(attempt)
+}
+
+// jobList holds the jobs of the in-memory and file queues.
+type jobList []Job
+
+func (l jobList) reserve(now time.Time, visibility time.Duration) (Job, bool) {
+	for i, job := range l {
+		if !job.VisibleAt.After(now) {
+			l[i].VisibleAt = now.Add(visibility)
+			return job, true
+		}
+	}
+	return Job{}, false
+}
+
+func (l jobList) ack(id string) jobList {
+	for i, job := range l {
+		if job.ID == id {
+			return append(l[:i], l[i+1:]...)
+		}
+	}
+	return l
+}
+
+func (l jobList) retry(job Job, runAt time.Time) error {
+	for i := range l {
+		if l[i].ID == job.ID {
+			job.VisibleAt = runAt
+			l[i] = job
+			return nil
+		}
+	}
+	return fmt.Errorf("job %s does not exist", job.ID)
+}
+
+type MemoryJobQueue struct {
+	mu   sync.Mutex
+	jobs jobList
+}
+
+func NewMemoryJobQueue() *MemoryJobQueue {
+	return &MemoryJobQueue{}
+}
+
+func (q *MemoryJobQueue) Push(job Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, job)
+	return nil
+}
+
+func (q *MemoryJobQueue) Reserve(now time.Time, visibility time.Duration) (Job, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs.reserve(now, visibility)
+	return job, ok, nil
+}
+
+func (q *MemoryJobQueue) Ack(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = q.jobs.ack(id)
+	return nil
+}
+
+func (q *MemoryJobQueue) Retry(job Job, runAt time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.jobs.retry(job, runAt)
+}
+
+// Jobs returns the jobs in the queue.
+func (q *MemoryJobQueue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Job{}, q.jobs...)
+}
+
+// FileJobQueue keeps its jobs in a JSON file, rewritten on every change, so
+// that they survive restarts.  It is meant for a single process.
+type FileJobQueue struct {
+	mu   sync.Mutex
+	path string
+	jobs jobList
+}
+
+func NewFileJobQueue(path string) (*FileJobQueue, error) {
+	q := &FileJobQueue{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &q.jobs)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *FileJobQueue) save() error {
+	data, err := json.Marshal(q.jobs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path, data)
+}
+
+func (q *FileJobQueue) Push(job Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, job)
+	return q.save()
+}
+
+func (q *FileJobQueue) Reserve(now time.Time, visibility time.Duration) (Job, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs.reserve(now, visibility)
+	if !ok {
+		return Job{}, false, nil
+	}
+	return job, true, q.save()
+}
+
+func (q *FileJobQueue) Ack(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = q.jobs.ack(id)
+	return q.save()
+}
+
+func (q *FileJobQueue) Retry(job Job, runAt time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.jobs.retry(job, runAt)
+	if err != nil {
+		return err
+	}
+	return q.save()
+}
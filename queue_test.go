@@ -0,0 +1,256 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type SendEmail struct {
+	To string `effects:"required"`
+}
+
+type mailer struct {
+	mu       sync.Mutex
+	sent     []string
+	failures int
+}
+
+func (m *mailer) interpret(ctx effects.Context, command interface{}) error {
+	switch cmd := command.(type) {
+	case *SendEmail:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.failures > 0 {
+			m.failures--
+			return errors.New("smtp unavailable")
+		}
+		m.sent = append(m.sent, cmd.To)
+		return nil
+	}
+	return interpreter(ctx, command)
+}
+
+func (m *mailer) Sent() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.sent...)
+}
+
+func newQueueContext(m *mailer, queue effects.JobQueue) effects.RealContext {
+	registry := effects.NewTypeRegistry()
+	registry.MustRegister("effects_test.SendEmail", &SendEmail{})
+	return effects.RealContext{
+		Context:     context.Background(),
+		Interpreter: m.interpret,
+		Queue:       queue,
+		Registry:    registry,
+	}
+}
+
+func TestEffectsEnqueue(t *testing.T) {
+	m := &mailer{}
+	queue := effects.NewMemoryJobQueue()
+	ctx := newQueueContext(m, queue)
+
+	err := ctx.Enqueue(&SendEmail{To: "a@example.com"}, effects.EnqueueOptions{})
+	assert.Nil(t, err)
+	err = ctx.Enqueue(&SendEmail{To: "b@example.com"}, effects.EnqueueOptions{Delay: time.Hour})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(m.Sent()))
+	assert.Equal(t, 2, len(queue.Jobs()))
+
+	worker := effects.Worker{Context: ctx}
+	ran, err := worker.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ran)
+	assert.Equal(t, []string{"a@example.com"}, m.Sent())
+
+	// the delayed job is not due yet
+	ran, err = worker.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ran)
+	assert.Equal(t, 1, len(queue.Jobs()))
+}
+
+func TestEffectsEnqueueErrors(t *testing.T) {
+	ctx := newQueueContext(&mailer{}, effects.NewMemoryJobQueue())
+
+	err := ctx.Enqueue(&SendEmail{}, effects.EnqueueOptions{})
+	assert.Equal(t, "invalid command *effects_test.SendEmail: To is required", err.Error())
+
+	err = ctx.Enqueue(&Now{}, effects.EnqueueOptions{})
+	assert.Equal(t, "*effects_test.Now has not been registered", err.Error())
+
+	err = effects.NewContext(context.Background(), interpreter).Enqueue(&Now{}, effects.EnqueueOptions{})
+	assert.Equal(t, "ctx.Enqueue(...) requires a RealContext with a Queue and a Registry", err.Error())
+}
+
+func TestEffectsWorkerRetries(t *testing.T) {
+	m := &mailer{failures: 3}
+	queue := effects.NewMemoryJobQueue()
+	ctx := newQueueContext(m, queue)
+
+	var failed []effects.Job
+	worker := effects.Worker{
+		Context: ctx,
+		Backoff: func(attempt int) time.Duration {
+			return 0
+		},
+		OnFailure: func(job effects.Job, err error) {
+			failed = append(failed, job)
+		},
+	}
+
+	assert.Nil(t, ctx.Enqueue(&SendEmail{To: "a@example.com"}, effects.EnqueueOptions{MaxAttempts: 2}))
+	assert.Nil(t, ctx.Enqueue(&SendEmail{To: "b@example.com"}, effects.EnqueueOptions{MaxAttempts: 3}))
+
+	for {
+		ran, err := worker.RunOnce(context.Background())
+		assert.Nil(t, err)
+		if !ran {
+			break
+		}
+	}
+
+	assert.Equal(t, []string{"b@example.com"}, m.Sent())
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, 2, failed[0].Attempts)
+	assert.Equal(t, "smtp unavailable", failed[0].LastError)
+	assert.Equal(t, 0, len(queue.Jobs()))
+}
+
+func TestEffectsWorkerVisibilityTimeout(t *testing.T) {
+	queue := effects.NewMemoryJobQueue()
+	ctx := newQueueContext(&mailer{}, queue)
+	assert.Nil(t, ctx.Enqueue(&SendEmail{To: "a@example.com"}, effects.EnqueueOptions{}))
+
+	// a worker that reserved the job and died
+	job, ok, err := queue.Reserve(time.Now(), time.Millisecond*20)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, ok, _ = queue.Reserve(time.Now(), time.Millisecond*20)
+	assert.False(t, ok)
+
+	again, ok, _ := queue.Reserve(time.Now().Add(time.Millisecond*30), time.Millisecond*20)
+	assert.True(t, ok)
+	assert.Equal(t, job.ID, again.ID)
+}
+
+func TestEffectsWorkerRun(t *testing.T) {
+	m := &mailer{}
+	var seen []string
+	mu := sync.Mutex{}
+	ctx := newQueueContext(m, effects.NewMemoryJobQueue())
+	ctx.Middleware = []effects.Middleware{
+		func(next func(effects.Context, interface{}) error) func(effects.Context, interface{}) error {
+			return func(ctx effects.Context, cmd interface{}) error {
+				mu.Lock()
+				seen = append(seen, cmd.(*SendEmail).To)
+				mu.Unlock()
+				return next(ctx, cmd)
+			}
+		},
+	}
+
+	for _, to := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		assert.Nil(t, ctx.Enqueue(&SendEmail{To: to}, effects.EnqueueOptions{}))
+	}
+
+	worker := effects.Worker{
+		Context:      ctx,
+		Concurrency:  2,
+		PollInterval: time.Millisecond,
+	}
+
+	runCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := worker.Run(runCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.ElementsMatch(t, []string{"a@example.com", "b@example.com", "c@example.com"}, m.Sent())
+	assert.ElementsMatch(t, []string{"a@example.com", "b@example.com", "c@example.com"}, seen)
+}
+
+func TestEffectsWorkerRunCancelled(t *testing.T) {
+	m := &mailer{}
+	queue := effects.NewMemoryJobQueue()
+	ctx := newQueueContext(m, queue)
+
+	for _, to := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"} {
+		assert.Nil(t, ctx.Enqueue(&SendEmail{To: to}, effects.EnqueueOptions{}))
+	}
+
+	worker := effects.Worker{
+		Context:      ctx,
+		Concurrency:  2,
+		PollInterval: time.Millisecond,
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := worker.Run(runCtx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, len(m.Sent()))
+
+	ran, err := worker.RunOnce(runCtx)
+	assert.False(t, ran)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, len(m.Sent()))
+}
+
+func TestEffectsExponentialBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, effects.ExponentialBackoff(1))
+	assert.Equal(t, 2*time.Second, effects.ExponentialBackoff(2))
+	assert.Equal(t, 8*time.Second, effects.ExponentialBackoff(4))
+	assert.Equal(t, effects.MaxBackoff, effects.ExponentialBackoff(13))
+	assert.Equal(t, effects.MaxBackoff, effects.ExponentialBackoff(35))
+	assert.Equal(t, effects.MaxBackoff, effects.ExponentialBackoff(100))
+}
+
+func TestEffectsFileJobQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "effects-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.json")
+
+	queue, err := effects.NewFileJobQueue(path)
+	assert.Nil(t, err)
+	ctx := newQueueContext(&mailer{}, queue)
+	assert.Nil(t, ctx.Enqueue(&SendEmail{To: "a@example.com"}, effects.EnqueueOptions{}))
+
+	// the job survives reopening the queue
+	reopened, err := effects.NewFileJobQueue(path)
+	assert.Nil(t, err)
+	m := &mailer{}
+	worker := effects.Worker{Context: newQueueContext(m, reopened)}
+	ran, err := worker.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ran)
+	assert.Equal(t, []string{"a@example.com"}, m.Sent())
+
+	reopened, err = effects.NewFileJobQueue(path)
+	assert.Nil(t, err)
+	_, ok, err := reopened.Reserve(time.Now(), time.Second)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestEffectsTestRunnerEnqueue(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Cmd(func(cmd *SendEmail) {
+		assert.Equal(t, &SendEmail{To: "a@example.com"}, cmd)
+	})
+
+	err := ctx.Enqueue(&SendEmail{To: "a@example.com"}, effects.EnqueueOptions{Delay: time.Hour})
+	assert.Nil(t, err)
+	ctx.Finished(t)
+}
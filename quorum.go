@@ -0,0 +1,100 @@
+package effects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrPending is the outcome of a command that had not finished when DoQuorum
+// returned.
+var ErrPending = errors.New("command did not finish before the quorum was decided")
+
+// QuorumError is returned by DoQuorum when the quorum can no longer be met.
+type QuorumError struct {
+	Needed    int
+	Succeeded int
+	AggregateError
+}
+
+func (e QuorumError) Error() string {
+	return fmt.Sprintf("quorum of %d not reached with %d successes: %s", e.Needed, e.Succeeded, e.AggregateError.Error())
+}
+
+// DoQuorum runs cmds, a slice of cmd pointers, concurrently and returns as
+// soon as n of them have succeeded or so many have failed that n can no
+// longer succeed.  Commands still running at that point are cancelled
+// through a context derived from ctx.  The returned slice holds the outcome
+// of each command by index: nil for success, its error for failure and
+// ErrPending for commands that had not finished.
+func (ctx RealContext) DoQuorum(cmds interface{}, n int) ([]error, error) {
+	list, err := cmdList("DoQuorum", cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 1 || n > len(list) {
+		return nil, fmt.Errorf("a quorum of %d cannot be reached with %d cmds passed to `DoQuorum`", n, len(list))
+	}
+
+	child, cancel := context.WithCancel(ctx.Context)
+	defer cancel()
+	quorumCtx := ctx
+	quorumCtx.Context = child
+
+	type result struct {
+		index int
+		err   error
+	}
+	results := make(chan result, len(list))
+
+	for i, cmd := range list {
+		go func(i int, c interface{}) {
+			results <- result{
+				index: i,
+				err:   quorumCtx.Do(c),
+			}
+		}(i, cmd)
+	}
+
+	outcomes := make([]error, len(list))
+	for i := range outcomes {
+		outcomes[i] = ErrPending
+	}
+
+	succeeded := 0
+	failed := 0
+	for range list {
+		r := <-results
+		outcomes[r.index] = r.err
+		if r.err == nil {
+			succeeded++
+		} else {
+			failed++
+		}
+
+		if succeeded >= n {
+			return outcomes, nil
+		}
+
+		if len(list)-failed < n {
+			return outcomes, QuorumError{
+				Needed:         n,
+				Succeeded:      succeeded,
+				AggregateError: AggregateError{Errors: failures(outcomes)},
+			}
+		}
+	}
+
+	return outcomes, nil
+}
+
+func failures(outcomes []error) []error {
+	var errs []error
+	for _, err := range outcomes {
+		if err != nil && err != ErrPending {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
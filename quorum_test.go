@@ -0,0 +1,97 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEffectsDoQuorum(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), replicaInterpreter)
+
+	cmds := []*Replica{
+		{Delay: time.Millisecond * 10},
+		{Delay: time.Millisecond * 20, Fail: true},
+		{Delay: time.Millisecond * 30},
+		{Delay: time.Hour},
+	}
+	outcomes, err := ctx.DoQuorum(cmds, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []error{nil, errors.New("replica failed"), nil, effects.ErrPending}, outcomes)
+	assert.Equal(t, "ok", cmds[0].Value)
+	assert.Equal(t, "ok", cmds[2].Value)
+}
+
+func TestEffectsDoQuorumUnreachable(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), replicaInterpreter)
+
+	cmds := []*Replica{
+		{Delay: time.Millisecond * 10, Fail: true},
+		{Delay: time.Millisecond * 20, Fail: true},
+		{Delay: time.Hour},
+	}
+	outcomes, err := ctx.DoQuorum(cmds, 2)
+	assert.Equal(t, []error{errors.New("replica failed"), errors.New("replica failed"), effects.ErrPending}, outcomes)
+	assert.Equal(t, "quorum of 2 not reached with 0 successes: replica failed; replica failed", err.Error())
+
+	quorumErr, ok := err.(effects.QuorumError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, quorumErr.Needed)
+	assert.Equal(t, 0, quorumErr.Succeeded)
+}
+
+func TestEffectsDoQuorumErrors(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	_, err := ctx.DoQuorum(true, 1)
+	assert.Equal(t, "a slice of cmd pointers must be passed to `DoQuorum` but a `bool` was passed instead", err.Error())
+
+	_, err = ctx.DoQuorum([]*Now{{}, {}}, 3)
+	assert.Equal(t, "a quorum of 3 cannot be reached with 2 cmds passed to `DoQuorum`", err.Error())
+}
+
+func TestEffectsTestRunnerDoQuorum(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Quorum(func(cmds []*Replica) []error {
+		cmds[0].Value = "ok"
+		cmds[2].Value = "ok"
+		return []error{nil, errors.New("replica failed"), nil}
+	})
+	ctx.Quorum(func(cmds []*Replica) []error {
+		return []error{nil, errors.New("replica failed"), effects.ErrPending}
+	})
+	ctx.Cmd(func(cmds []*Replica) {})
+
+	cmds := []*Replica{{}, {}, {}}
+	outcomes, err := ctx.DoQuorum(cmds, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []error{nil, errors.New("replica failed"), nil}, outcomes)
+
+	_, err = ctx.DoQuorum([]*Replica{{}, {}, {}}, 2)
+	assert.Equal(t, "quorum of 2 not reached with 1 successes: replica failed", err.Error())
+
+	outcomes, err = ctx.DoQuorum([]*Replica{{}, {}}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []error{nil, nil}, outcomes)
+
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerDoQuorumErrors(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	_, err := ctx.DoQuorum(&Now{}, 1)
+	assert.Equal(t, "a slice of cmd pointers must be passed to `DoQuorum` but a `ptr` was passed instead", err.Error())
+
+	_, err = ctx.DoQuorum([]*Replica{{}, {}}, 3)
+	assert.Equal(t, "a quorum of 3 cannot be reached with 2 cmds passed to `DoQuorum`", err.Error())
+
+	_, err = ctx.DoQuorum([]*Replica{{}, {}}, 0)
+	assert.Equal(t, "a quorum of 0 cannot be reached with 2 cmds passed to `DoQuorum`", err.Error())
+
+	ctx.Finished(t)
+}
@@ -0,0 +1,73 @@
+package effects
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// AggregateError collects the errors of several commands.
+type AggregateError struct {
+	Errors []error
+}
+
+func (e AggregateError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e AggregateError) Unwrap() []error {
+	return e.Errors
+}
+
+// DoRace runs cmds, a slice of cmd pointers, concurrently and returns the
+// index of the first command to succeed.  The remaining commands are
+// cancelled through a context derived from ctx and are not waited for.  If
+// every command fails, DoRace returns -1 and an AggregateError holding the
+// error of each command by index.
+func (ctx RealContext) DoRace(cmds interface{}) (int, error) {
+	list, err := cmdList("DoRace", cmds)
+	if err != nil {
+		return -1, err
+	}
+
+	if len(list) == 0 {
+		return -1, errors.New("at least one cmd must be passed to `DoRace`")
+	}
+
+	child, cancel := context.WithCancel(ctx.Context)
+	defer cancel()
+	raceCtx := ctx
+	raceCtx.Context = child
+
+	type result struct {
+		index int
+		err   error
+	}
+	results := make(chan result, len(list))
+
+	for i, cmd := range list {
+		go func(i int, c interface{}) {
+			results <- result{
+				index: i,
+				err:   raceCtx.Do(c),
+			}
+		}(i, cmd)
+	}
+
+	errs := make([]error, len(list))
+	for range list {
+		r := <-results
+		if r.err == nil {
+			return r.index, nil
+		}
+		errs[r.index] = r.err
+	}
+
+	return -1, AggregateError{Errors: errs}
+}
@@ -0,0 +1,135 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type Replica struct {
+	Delay time.Duration
+	Fail  bool
+	Value string
+}
+
+func replicaInterpreter(ctx effects.Context, command interface{}) error {
+	cmd := command.(*Replica)
+	select {
+	case <-time.After(cmd.Delay):
+		if cmd.Fail {
+			return errors.New("replica failed")
+		}
+		cmd.Value = "ok"
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestEffectsDoRace(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), replicaInterpreter)
+
+	cmds := []*Replica{
+		{Delay: time.Second},
+		{Delay: time.Millisecond * 10, Fail: true},
+		{Delay: time.Millisecond * 20},
+	}
+	index, err := ctx.DoRace(cmds)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, index)
+	assert.Equal(t, "ok", cmds[2].Value)
+}
+
+func TestEffectsDoRaceAllFail(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	index, err := ctx.DoRace([]*ErrorOut{{}, {}})
+	assert.Equal(t, -1, index)
+	assert.Equal(t, effects.AggregateError{Errors: []error{errors.New("oops"), errors.New("oops")}}, err)
+	assert.Equal(t, "oops; oops", err.Error())
+}
+
+func TestEffectsDoRaceCancelsLosers(t *testing.T) {
+	cancelled := make(chan struct{})
+	ctx := effects.NewContext(context.Background(), func(ctx effects.Context, command interface{}) error {
+		cmd := command.(*Replica)
+		if cmd.Delay == 0 {
+			return nil
+		}
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+
+	index, err := ctx.DoRace([]*Replica{{Delay: time.Hour}, {}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the losing command was not cancelled")
+	}
+}
+
+func TestEffectsDoRaceErrors(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	_, err := ctx.DoRace(true)
+	assert.Equal(t, "a slice of cmd pointers must be passed to `DoRace` but a `bool` was passed instead", err.Error())
+
+	_, err = ctx.DoRace([]Now{{}})
+	assert.Equal(t, "a slice of ptrs must be passed to `DoRace` but the slice contains a `struct` at index 0", err.Error())
+
+	_, err = ctx.DoRace([]*Now{})
+	assert.Equal(t, "at least one cmd must be passed to `DoRace`", err.Error())
+}
+
+func TestEffectsTestRunnerDoRace(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Race(func(cmds []*Replica) (int, error) {
+		assert.Equal(t, 2, len(cmds))
+		cmds[1].Value = "ok"
+		return 1, nil
+	})
+	ctx.Cmd(func(cmds []*Replica) {
+		cmds[0].Value = "ok"
+	})
+	ctx.Cmd(func(cmds []*Replica) error {
+		return errors.New("all failed")
+	})
+
+	cmds := []*Replica{{}, {}}
+	index, err := ctx.DoRace(cmds)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index)
+	assert.Equal(t, "ok", cmds[1].Value)
+
+	index, err = ctx.DoRace([]*Replica{{}, {}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, index)
+
+	index, err = ctx.DoRace([]*Replica{{}, {}})
+	assert.Equal(t, -1, index)
+	assert.Equal(t, "all failed", err.Error())
+
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerDoRaceErrors(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+	ctx.Expect(effects.Any()).AnyTimes()
+
+	_, err := ctx.DoRace(&Now{})
+	assert.Equal(t, "a slice of cmd pointers must be passed to `DoRace` but a `ptr` was passed instead", err.Error())
+
+	index, err := ctx.DoRace([]*Now{})
+	assert.Equal(t, -1, index)
+	assert.Equal(t, "at least one cmd must be passed to `DoRace`", err.Error())
+
+	ctx.Finished(t)
+}
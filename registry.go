@@ -0,0 +1,238 @@
+package effects
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	slicePrefix  = "[]"
+	sequenceName = "effects.Sequence"
+	parallelName = "effects.Parallel"
+)
+
+// Envelope is the serialized form of a command: the name its type was
+// registered under and its JSON payload.  Slices of commands are named after
+// their element type with a "[]" prefix.  Sequence and Parallel are always
+// known as "effects.Sequence" and "effects.Parallel".
+type Envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// TypeRegistry maps command types to stable names so that commands can be
+// serialized and reconstructed in another process.
+type TypeRegistry struct {
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		types: map[string]reflect.Type{},
+		names: map[reflect.Type]string{},
+	}
+}
+
+// Register registers the type of cmd, which must be a pointer such as &Now{}
+// or (*Now)(nil), under name.
+func (r *TypeRegistry) Register(name string, cmd interface{}) error {
+	t := reflect.TypeOf(cmd)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return fmt.Errorf("a cmd pointer must be passed to `Register` but a `%v` was passed instead", kindOf(t))
+	}
+	if name == "" || name == sequenceName || name == parallelName || strings.HasPrefix(name, slicePrefix) {
+		return fmt.Errorf("`%s` is not a valid name for %v", name, t)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.types[name]; ok {
+		return fmt.Errorf("`%s` is already registered to %v", name, existing)
+	}
+	if existing, ok := r.names[t]; ok {
+		return fmt.Errorf("%v is already registered as `%s`", t, existing)
+	}
+
+	r.types[name] = t
+	r.names[t] = name
+	return nil
+}
+
+// MustRegister is like Register but panics on error.
+func (r *TypeRegistry) MustRegister(name string, cmd interface{}) {
+	err := r.Register(name, cmd)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Name returns the name the type of cmd is registered under.
+func (r *TypeRegistry) Name(cmd interface{}) (string, bool) {
+	t := reflect.TypeOf(cmd)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if t != nil && t.Kind() == reflect.Slice {
+		name, ok := r.names[t.Elem()]
+		return slicePrefix + name, ok
+	}
+
+	name, ok := r.names[t]
+	return name, ok
+}
+
+func (r *TypeRegistry) Marshal(cmd interface{}) ([]byte, error) {
+	env, err := r.Envelope(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+func (r *TypeRegistry) Unmarshal(data []byte) (interface{}, error) {
+	env := Envelope{}
+	err := json.Unmarshal(data, &env)
+	if err != nil {
+		return nil, err
+	}
+	return r.Open(env)
+}
+
+// Envelope wraps cmd, a registered cmd pointer or a slice of them, in an
+// Envelope.  A slice of interfaces holding cmd pointers of different types is
+// wrapped in an Envelope named "[]" whose payload is a list of Envelopes.
+func (r *TypeRegistry) Envelope(cmd interface{}) (Envelope, error) {
+	switch c := cmd.(type) {
+	case *Sequence:
+		return r.namedMixedEnvelope(sequenceName, []interface{}(*c))
+	case *Parallel:
+		return r.namedMixedEnvelope(parallelName, []interface{}(*c))
+	}
+
+	t := reflect.TypeOf(cmd)
+	if t != nil && t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Interface {
+		return r.namedMixedEnvelope(slicePrefix, cmd)
+	}
+
+	name, ok := r.Name(cmd)
+	if !ok {
+		return Envelope{}, fmt.Errorf("%T has not been registered", cmd)
+	}
+
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		Type:    name,
+		Payload: payload,
+	}, nil
+}
+
+// Open reconstructs the cmd pointer, or slice of cmd pointers, held by env.
+func (r *TypeRegistry) Open(env Envelope) (interface{}, error) {
+	switch env.Type {
+	case slicePrefix:
+		return r.openMixed(env)
+
+	case sequenceName:
+		cmds, err := r.openMixed(env)
+		if err != nil {
+			return nil, err
+		}
+		s := Sequence(cmds)
+		return &s, nil
+
+	case parallelName:
+		cmds, err := r.openMixed(env)
+		if err != nil {
+			return nil, err
+		}
+		p := Parallel(cmds)
+		return &p, nil
+	}
+
+	name := strings.TrimPrefix(env.Type, slicePrefix)
+
+	r.mu.RLock()
+	t, ok := r.types[name]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no type is registered as `%s`", name)
+	}
+
+	if name != env.Type {
+		t = reflect.SliceOf(t)
+	}
+
+	value := reflect.New(t)
+	if t.Kind() == reflect.Ptr {
+		value.Elem().Set(reflect.New(t.Elem()))
+	}
+
+	err := json.Unmarshal(env.Payload, value.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	return value.Elem().Interface(), nil
+}
+
+func (r *TypeRegistry) namedMixedEnvelope(name string, cmds interface{}) (Envelope, error) {
+	list, err := cmdList("Marshal", cmds)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	envs := make([]Envelope, len(list))
+	for i, cmd := range list {
+		envs[i], err = r.Envelope(cmd)
+		if err != nil {
+			return Envelope{}, err
+		}
+	}
+
+	payload, err := json.Marshal(envs)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		Type:    name,
+		Payload: payload,
+	}, nil
+}
+
+func (r *TypeRegistry) openMixed(env Envelope) ([]interface{}, error) {
+	var envs []Envelope
+	err := json.Unmarshal(env.Payload, &envs)
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]interface{}, len(envs))
+	for i, e := range envs {
+		cmds[i], err = r.Open(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cmds, nil
+}
+
+func kindOf(t reflect.Type) reflect.Kind {
+	if t == nil {
+		return reflect.Invalid
+	}
+	return t.Kind()
+}
@@ -0,0 +1,80 @@
+package effects_test
+
+import (
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newRegistry() *effects.TypeRegistry {
+	registry := effects.NewTypeRegistry()
+	registry.MustRegister("effects_test.Now", &Now{})
+	registry.MustRegister("effects_test.Get", (*Get)(nil))
+	return registry
+}
+
+func TestEffectsRegistryMarshal(t *testing.T) {
+	registry := newRegistry()
+
+	data, err := registry.Marshal(&Get{URL: "https://example.com", Body: "{}"})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"type":"effects_test.Get","payload":{"URL":"https://example.com","Body":"{}"}}`, string(data))
+
+	cmd, err := registry.Unmarshal(data)
+	assert.Nil(t, err)
+	assert.Equal(t, &Get{URL: "https://example.com", Body: "{}"}, cmd)
+}
+
+func TestEffectsRegistryMarshalSlice(t *testing.T) {
+	registry := newRegistry()
+
+	data, err := registry.Marshal([]*Now{{Time: now}, {}})
+	assert.Nil(t, err)
+
+	cmds, err := registry.Unmarshal(data)
+	assert.Nil(t, err)
+	assert.IsType(t, []*Now{}, cmds)
+	assert.Equal(t, 2, len(cmds.([]*Now)))
+	assert.True(t, now.Equal(cmds.([]*Now)[0].Time))
+}
+
+func TestEffectsRegistryUnregisteredType(t *testing.T) {
+	registry := newRegistry()
+
+	_, err := registry.Marshal(&Panic{})
+	assert.Equal(t, "*effects_test.Panic has not been registered", err.Error())
+
+	_, err = registry.Unmarshal([]byte(`{"type":"effects_test.Panic","payload":{}}`))
+	assert.Equal(t, "no type is registered as `effects_test.Panic`", err.Error())
+}
+
+func TestEffectsRegistryRegisterErrors(t *testing.T) {
+	registry := newRegistry()
+
+	err := registry.Register("effects_test.Now", &Panic{})
+	assert.Equal(t, "`effects_test.Now` is already registered to *effects_test.Now", err.Error())
+
+	err = registry.Register("Now", &Now{})
+	assert.Equal(t, "*effects_test.Now is already registered as `effects_test.Now`", err.Error())
+
+	err = registry.Register("Panic", Panic{})
+	assert.Equal(t, "a cmd pointer must be passed to `Register` but a `struct` was passed instead", err.Error())
+}
+
+func TestEffectsRegistryMarshalMixedSlice(t *testing.T) {
+	registry := newRegistry()
+
+	data, err := registry.Marshal([]interface{}{&Get{URL: "/a"}, &Now{}})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"type":"[]","payload":[
+		{"type":"effects_test.Get","payload":{"URL":"/a","Body":""}},
+		{"type":"effects_test.Now","payload":{"Time":"0001-01-01T00:00:00Z"}}
+	]}`, string(data))
+
+	cmds, err := registry.Unmarshal(data)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{&Get{URL: "/a"}, &Now{}}, cmds)
+
+	_, err = registry.Marshal([]interface{}{&Get{}, &Panic{}})
+	assert.Equal(t, "*effects_test.Panic has not been registered", err.Error())
+}
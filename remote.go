@@ -0,0 +1,250 @@
+package effects
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// DeadlineHeader carries the caller's context deadline to a RemoteHandler.
+const DeadlineHeader = "Effects-Deadline"
+
+// Kinds of RemoteError.
+const (
+	RemoteErrorValidation = "validation"
+	RemoteErrorForbidden  = "forbidden"
+	RemoteErrorPanic      = "panic"
+	RemoteErrorDeadline   = "deadline_exceeded"
+	RemoteErrorCanceled   = "canceled"
+	RemoteErrorProtocol   = "protocol"
+	RemoteErrorUnknown    = "error"
+)
+
+// RemoteError is returned by RemoteClient when the remote interpreter fails.
+// Kind identifies the class of failure; errors.Is matches ErrForbidden,
+// context.DeadlineExceeded and context.Canceled for the matching kinds.
+type RemoteError struct {
+	Cmd     interface{}  `json:"-"`
+	Kind    string       `json:"kind"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func (e RemoteError) Error() string {
+	return e.Message
+}
+
+func (e RemoteError) Is(target error) bool {
+	switch e.Kind {
+	case RemoteErrorForbidden:
+		return target == ErrForbidden
+	case RemoteErrorDeadline:
+		return target == context.DeadlineExceeded
+	case RemoteErrorCanceled:
+		return target == context.Canceled
+	}
+	return false
+}
+
+type remoteResponse struct {
+	Cmd   *Envelope    `json:"cmd,omitempty"`
+	Error *RemoteError `json:"error,omitempty"`
+}
+
+// RemoteHandler exposes an interpreter over HTTP.  It accepts a POSTed
+// Envelope, runs the command and responds with the populated command and the
+// error, if any.
+type RemoteHandler struct {
+	Registry    *TypeRegistry
+	Interpreter func(Context, interface{}) error
+	Policy      *Policy
+}
+
+func NewRemoteHandler(registry *TypeRegistry, interpreter func(Context, interface{}) error) *RemoteHandler {
+	return &RemoteHandler{
+		Registry:    registry,
+		Interpreter: interpreter,
+	}
+}
+
+func (h *RemoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	env := Envelope{}
+	err := json.NewDecoder(r.Body).Decode(&env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cmd, err := h.Registry.Open(env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if header := r.Header.Get(DeadlineHeader); header != "" {
+		deadline, err := time.Parse(time.RFC3339Nano, header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	effectsCtx := RealContext{
+		Context:     ctx,
+		Interpreter: h.Interpreter,
+		Policy:      h.Policy,
+	}
+
+	response := remoteResponse{}
+	cmdErr := effectsCtx.Do(cmd)
+	if cmdErr != nil {
+		remoteErr := toRemoteError(cmdErr)
+		response.Error = &remoteErr
+	}
+
+	result, err := h.Registry.Envelope(cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Cmd = &result
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func toRemoteError(err error) RemoteError {
+	remoteErr := RemoteError{
+		Kind:    RemoteErrorUnknown,
+		Message: err.Error(),
+	}
+
+	var validationErr ValidationError
+	var interpreterErr InterpreterError
+	switch {
+	case errors.As(err, &validationErr):
+		remoteErr.Kind = RemoteErrorValidation
+		remoteErr.Fields = validationErr.Fields
+	case errors.Is(err, ErrForbidden):
+		remoteErr.Kind = RemoteErrorForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		remoteErr.Kind = RemoteErrorDeadline
+	case errors.Is(err, context.Canceled):
+		remoteErr.Kind = RemoteErrorCanceled
+	case errors.As(err, &interpreterErr):
+		remoteErr.Kind = RemoteErrorPanic
+	}
+
+	return remoteErr
+}
+
+// RemoteClient sends commands to a RemoteHandler.
+type RemoteClient struct {
+	URL        string
+	Registry   *TypeRegistry
+	HTTPClient *http.Client
+}
+
+// Interpret runs cmd on the remote interpreter and copies the populated
+// command back into cmd.  It has the signature of an interpreter.
+func (c *RemoteClient) Interpret(ctx Context, cmd interface{}) error {
+	body, err := c.Registry.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(DeadlineHeader, deadline.Format(time.RFC3339Nano))
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return RemoteError{
+			Cmd:     cmd,
+			Kind:    RemoteErrorProtocol,
+			Message: fmt.Sprintf("remote interpreter responded with %d: %s", res.StatusCode, bytes.TrimSpace(msg)),
+		}
+	}
+
+	response := remoteResponse{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+
+	if response.Cmd != nil {
+		result, err := c.Registry.Open(*response.Cmd)
+		if err != nil {
+			return err
+		}
+		target := reflect.ValueOf(cmd).Elem()
+		source := reflect.ValueOf(result)
+		if source.Type() != reflect.TypeOf(cmd) {
+			return RemoteError{
+				Cmd:     cmd,
+				Kind:    RemoteErrorProtocol,
+				Message: fmt.Sprintf("remote interpreter responded with a %v to a %T", source.Type(), cmd),
+			}
+		}
+		target.Set(source.Elem())
+	}
+
+	if response.Error != nil {
+		remoteErr := *response.Error
+		remoteErr.Cmd = cmd
+		return remoteErr
+	}
+
+	return nil
+}
+
+// Interpreter returns an interpreter that sends commands of the same types as
+// cmds to the remote interpreter and everything else to fallback.
+func (c *RemoteClient) Interpreter(fallback func(Context, interface{}) error, cmds ...interface{}) func(Context, interface{}) error {
+	remote := map[reflect.Type]bool{}
+	for _, cmd := range cmds {
+		remote[reflect.TypeOf(cmd)] = true
+	}
+
+	return func(ctx Context, cmd interface{}) error {
+		if remote[reflect.TypeOf(cmd)] {
+			return c.Interpret(ctx, cmd)
+		}
+		return fallback(ctx, cmd)
+	}
+}
@@ -0,0 +1,151 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// CheckDeadline records the deadline of the context it is interpreted with.
+type CheckDeadline struct {
+	Deadline    time.Time
+	HasDeadline bool
+}
+
+func newRemote() (*effects.RemoteClient, func()) {
+	registry := newRegistry()
+	registry.MustRegister("effects_test.Panic", &Panic{})
+	registry.MustRegister("effects_test.ErrorOut", &ErrorOut{})
+	registry.MustRegister("effects_test.NeverReturn", &NeverReturn{})
+	registry.MustRegister("effects_test.Fetch", &Fetch{})
+	registry.MustRegister("effects_test.CheckDeadline", &CheckDeadline{})
+
+	remoteInterpreter := func(ctx effects.Context, command interface{}) error {
+		switch cmd := command.(type) {
+		case *Get:
+			cmd.Body = "remote: " + cmd.URL
+			return nil
+		case *Fetch:
+			cmd.Body = "fetched"
+			return nil
+		case *CheckDeadline:
+			cmd.Deadline, cmd.HasDeadline = ctx.Deadline()
+			return nil
+		}
+		return interpreter(ctx, command)
+	}
+
+	server := httptest.NewServer(effects.NewRemoteHandler(registry, remoteInterpreter))
+	client := &effects.RemoteClient{
+		URL:        server.URL,
+		Registry:   registry,
+		HTTPClient: server.Client(),
+	}
+	return client, server.Close
+}
+
+func TestEffectsRemoteInterpreter(t *testing.T) {
+	client, closeServer := newRemote()
+	defer closeServer()
+
+	localInterpreter := func(ctx effects.Context, command interface{}) error {
+		switch cmd := command.(type) {
+		case *Get:
+			cmd.Body = "local"
+			return nil
+		}
+		return errors.New("unexpected local command")
+	}
+
+	ctx := effects.NewContext(context.Background(), client.Interpreter(localInterpreter, &Now{}, &ErrorOut{}, &Panic{}))
+
+	n := Now{}
+	err := ctx.Do(&n)
+	assert.Nil(t, err)
+	assert.True(t, now.Equal(n.Time))
+
+	g := Get{URL: "https://example.com"}
+	err = ctx.Do(&g)
+	assert.Nil(t, err)
+	assert.Equal(t, "local", g.Body)
+}
+
+func TestEffectsRemoteInterpreterErrors(t *testing.T) {
+	client, closeServer := newRemote()
+	defer closeServer()
+
+	ctx := effects.NewContext(context.Background(), client.Interpret)
+
+	err := ctx.Do(&ErrorOut{})
+	assert.Equal(t, effects.RemoteError{Cmd: &ErrorOut{}, Kind: effects.RemoteErrorUnknown, Message: "oops"}, err)
+
+	err = ctx.Do(&Panic{})
+	assert.Equal(t, effects.RemoteError{Cmd: &Panic{}, Kind: effects.RemoteErrorPanic, Message: "oops"}, err)
+
+	err = ctx.Do(&Lookup{ID: 1})
+	assert.Equal(t, "*effects_test.Lookup has not been registered", err.Error())
+}
+
+func TestEffectsRemoteInterpreterValidationError(t *testing.T) {
+	client, closeServer := newRemote()
+	defer closeServer()
+
+	ctx := effects.NewContext(context.Background(), nil)
+
+	fetch := &Fetch{}
+	err := client.Interpret(ctx, fetch)
+	remoteErr, ok := err.(effects.RemoteError)
+	assert.True(t, ok)
+	assert.Equal(t, effects.RemoteErrorValidation, remoteErr.Kind)
+	assert.Equal(t, []effects.FieldError{
+		{Field: "URL", Message: "is required"},
+		{Field: "ID", Message: "is required"},
+	}, remoteErr.Fields)
+	assert.Equal(t, "", fetch.Body)
+}
+
+func TestEffectsRemoteInterpreterDeadline(t *testing.T) {
+	client, closeServer := newRemote()
+	defer closeServer()
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	ctx := effects.NewContext(timeoutCtx, client.Interpret)
+
+	err := ctx.Do(&NeverReturn{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// the deadline becomes the deadline of the remote interpreter's context
+	deadline := time.Now().Add(time.Hour)
+	deadlineCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	check := CheckDeadline{}
+	assert.Nil(t, effects.NewContext(deadlineCtx, client.Interpret).Do(&check))
+	assert.True(t, check.HasDeadline)
+	assert.True(t, deadline.Equal(check.Deadline))
+
+	check = CheckDeadline{}
+	assert.Nil(t, effects.NewContext(context.Background(), client.Interpret).Do(&check))
+	assert.False(t, check.HasDeadline)
+}
+
+func TestEffectsRemoteInterpreterProtocolError(t *testing.T) {
+	client, closeServer := newRemote()
+	defer closeServer()
+
+	client.URL += "/missing"
+	client.Registry = effects.NewTypeRegistry()
+	client.Registry.MustRegister("effects_test.Missing", &Now{})
+	ctx := effects.NewContext(context.Background(), client.Interpret)
+
+	err := ctx.Do(&Now{})
+	remoteErr, ok := err.(effects.RemoteError)
+	assert.True(t, ok)
+	assert.Equal(t, effects.RemoteErrorProtocol, remoteErr.Kind)
+	assert.Equal(t, "remote interpreter responded with 400: no type is registered as `effects_test.Missing`", remoteErr.Message)
+}
@@ -0,0 +1,119 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Streamer is implemented by commands that produce a sequence of items
+// instead of populating themselves.  Stream should call emit for every item
+// and stop when emit returns an error.
+type Streamer interface {
+	Stream(ctx Context, emit func(interface{}) error) error
+}
+
+// Stream is the consumer side of a command passed to DoStream.
+type Stream interface {
+	// Next blocks until the next item is available.  It returns false once
+	// the stream is exhausted, after which Err reports why it ended.
+	Next() (interface{}, bool)
+	Err() error
+	// Close stops the producer.  Items that have not been read are dropped.
+	Close()
+}
+
+type stream struct {
+	items  chan interface{}
+	err    error
+	closed int32
+	cancel context.CancelFunc
+}
+
+func (s *stream) Next() (interface{}, bool) {
+	item, ok := <-s.items
+	return item, ok
+}
+
+func (s *stream) Err() error {
+	return s.err
+}
+
+func (s *stream) Close() {
+	atomic.StoreInt32(&s.closed, 1)
+	s.cancel()
+	for range s.items {
+	}
+}
+
+func staticStream(items []interface{}, err error) Stream {
+	s := &stream{
+		items:  make(chan interface{}, len(items)),
+		err:    err,
+		cancel: func() {},
+	}
+	for _, item := range items {
+		s.items <- item
+	}
+	close(s.items)
+	return s
+}
+
+// DoStream starts the producer for cmd in a goroutine and returns a Stream
+// of its items.  cmd must implement Streamer or ctx must have a
+// StreamInterpreter.  The producer blocks in emit until the consumer calls
+// Next, and emit fails once ctx ends or the stream is closed.
+func (ctx RealContext) DoStream(cmd interface{}) (Stream, error) {
+	err := ctx.prepare("DoStream", cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	streamer, isStreamer := cmd.(Streamer)
+	if !isStreamer && ctx.StreamInterpreter == nil {
+		return nil, fmt.Errorf("%T does not implement Streamer and there is no StreamInterpreter", cmd)
+	}
+
+	child, cancel := context.WithCancel(ctx.Context)
+	streamCtx := ctx
+	streamCtx.Context = child
+
+	s := &stream{
+		items:  make(chan interface{}),
+		cancel: cancel,
+	}
+
+	emit := func(item interface{}) error {
+		select {
+		case s.items <- item:
+			return nil
+		case <-child.Done():
+			return child.Err()
+		}
+	}
+
+	go func() {
+		defer cancel()
+		defer close(s.items)
+		defer func() {
+			r := recover()
+			if r != nil {
+				s.err = recoveredError(r, cmd)
+			}
+		}()
+
+		var err error
+		if isStreamer {
+			err = streamer.Stream(streamCtx, emit)
+		} else {
+			err = ctx.StreamInterpreter(streamCtx, cmd, emit)
+		}
+
+		if err == context.Canceled && atomic.LoadInt32(&s.closed) == 1 {
+			err = nil
+		}
+		s.err = err
+	}()
+
+	return s, nil
+}
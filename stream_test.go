@@ -0,0 +1,204 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type ListObjects struct {
+	Bucket string `effects:"required"`
+}
+
+type Countdown struct {
+	From int
+}
+
+func (c *Countdown) Stream(ctx effects.Context, emit func(interface{}) error) error {
+	for i := c.From; i > 0; i-- {
+		err := emit(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Tail struct{}
+
+func streamInterpreter(ctx effects.Context, command interface{}, emit func(interface{}) error) error {
+	switch cmd := command.(type) {
+	case *ListObjects:
+		for _, key := range []string{"a", "b", "c"} {
+			err := emit(cmd.Bucket + "/" + key)
+			if err != nil {
+				return err
+			}
+		}
+		return errors.New("listing truncated")
+
+	case *Tail:
+		for i := 0; ; i++ {
+			err := emit(i)
+			if err != nil {
+				return err
+			}
+		}
+
+	case *Panic:
+		panic("oops")
+	}
+	return nil
+}
+
+func newStreamContext(ctx context.Context) effects.Context {
+	return effects.RealContext{
+		Context:           ctx,
+		Interpreter:       interpreter,
+		StreamInterpreter: streamInterpreter,
+	}
+}
+
+func collect(s effects.Stream) []interface{} {
+	var items []interface{}
+	for {
+		item, ok := s.Next()
+		if !ok {
+			return items
+		}
+		items = append(items, item)
+	}
+}
+
+func TestEffectsDoStreamStreamer(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	s, err := ctx.DoStream(&Countdown{From: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{3, 2, 1}, collect(s))
+	assert.Nil(t, s.Err())
+}
+
+func TestEffectsDoStreamInterpreter(t *testing.T) {
+	ctx := newStreamContext(context.Background())
+
+	s, err := ctx.DoStream(&ListObjects{Bucket: "photos"})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"photos/a", "photos/b", "photos/c"}, collect(s))
+	assert.Equal(t, "listing truncated", s.Err().Error())
+}
+
+func TestEffectsDoStreamErrors(t *testing.T) {
+	ctx := newStreamContext(context.Background())
+
+	_, err := ctx.DoStream(ListObjects{})
+	assert.Equal(t, "ctx.DoStream(...) must receive a ptr", err.Error())
+
+	_, err = ctx.DoStream(&ListObjects{})
+	assert.Equal(t, "invalid command *effects_test.ListObjects: Bucket is required", err.Error())
+
+	_, err = effects.NewContext(context.Background(), interpreter).DoStream(&ListObjects{Bucket: "photos"})
+	assert.Equal(t, "*effects_test.ListObjects does not implement Streamer and there is no StreamInterpreter", err.Error())
+
+	s, err := ctx.DoStream(&Panic{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(collect(s)))
+	assert.Equal(t, "oops", s.Err().Error())
+}
+
+func TestEffectsDoStreamClose(t *testing.T) {
+	ctx := newStreamContext(context.Background())
+
+	s, err := ctx.DoStream(&Tail{})
+	assert.Nil(t, err)
+
+	item, ok := s.Next()
+	assert.True(t, ok)
+	assert.Equal(t, 0, item)
+
+	s.Close()
+	_, ok = s.Next()
+	assert.False(t, ok)
+	assert.Nil(t, s.Err())
+}
+
+func TestEffectsDoStreamCancelledWithContext(t *testing.T) {
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	ctx := newStreamContext(timeoutCtx)
+
+	s, err := ctx.DoStream(&Tail{})
+	assert.Nil(t, err)
+
+	// leave the producer blocked in emit until the context times out
+	<-ctx.Done()
+	for {
+		_, ok := s.Next()
+		if !ok {
+			break
+		}
+	}
+	assert.Equal(t, context.DeadlineExceeded, s.Err())
+}
+
+func TestEffectsTestRunnerDoStream(t *testing.T) {
+	ctx := effects.NewTestContext(t)
+
+	ctx.Stream(func(cmd *ListObjects) []string {
+		assert.Equal(t, &ListObjects{Bucket: "photos"}, cmd)
+		return []string{"photos/a", "photos/b"}
+	})
+	ctx.Stream(func(cmd *ListObjects) ([]string, error) {
+		return []string{"logs/a"}, errors.New("listing truncated")
+	})
+
+	s, err := ctx.DoStream(&ListObjects{Bucket: "photos"})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"photos/a", "photos/b"}, collect(s))
+	assert.Nil(t, s.Err())
+
+	s, err = ctx.DoStream(&ListObjects{Bucket: "logs"})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"logs/a"}, collect(s))
+	assert.Equal(t, "listing truncated", s.Err().Error())
+
+	ctx.Finished(t)
+}
+
+func TestEffectsTestRunnerStreamMustReturnSlice(t *testing.T) {
+	ctx := effects.NewTestContext(t, effects.PanicOnFailure())
+
+	ctx.Stream(func(cmd *ListObjects) string { return "" })
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Errorf("The code did not panic")
+		} else {
+			assert.Contains(t, r, "functions passed to ctx.Stream(...) must return a slice of items, optionally followed by an error")
+		}
+	}()
+
+	ctx.DoStream(&ListObjects{})
+}
+
+func TestEffectsTestRunnerDoStreamReturnsErrors(t *testing.T) {
+	tb := &fakeTB{}
+	ctx := effects.NewTestContext(tb)
+	ctx.Cmd(func(cmd *ListObjects) error {
+		return errors.New("bucket not found")
+	})
+
+	s, err := ctx.DoStream(&ListObjects{Bucket: "photos"})
+	assert.Nil(t, s)
+	assert.Equal(t, "bucket not found", err.Error())
+
+	// a command that was not expected fails the test
+	s, err = ctx.DoStream(&ListObjects{Bucket: "logs"})
+	assert.Nil(t, s)
+	assert.Equal(t, effects.ErrTestFailure, err)
+	assert.True(t, tb.Failed())
+}
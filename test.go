@@ -2,13 +2,24 @@ package effects
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/sanity-io/litter"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// ErrTestFailure is returned for the commands that fail the test, e.g.
+// because no expectation matches them, so that the function under test stops
+// as it would for any other error.
+var ErrTestFailure = errors.New("effects: the command failed the test")
+
 type TestContext struct {
 	Context     context.Context
 	Parent      *TestContext
@@ -16,40 +27,897 @@ type TestContext struct {
 	Args        []interface{}
 	Expected    [][]interface{}
 	ShouldAbort bool
-	CmdQueue    []func(interface{}) error
+	CmdQueue    []*Expectation
 	CmdIndex    int
 	FnArgs      []interface{}
 	FnErr       error
-	T           *testing.T
+	T           testing.TB
+
+	unordered     bool
+	expandBatches bool
+	panics        bool
+	finished      bool
+	fallback      func(Context, interface{}) error
+	runCallables  bool
+	log           []TestLogEntry
+	groups        int
+	anyOrder      bool
+
+	mu sync.Mutex
 }
 
-func (ctx *TestContext) Do(cmd interface{}) error {
-	if ctx.CmdIndex >= len(ctx.CmdQueue) {
-		ctx.T.Fatalf("attempting to process a command (number %d in your function) not specified in your test.  You'll need to add another ctx.Cmd(...) to your test to account for this command:\n%s", ctx.CmdIndex+1, litter.Sdump(cmd))
+// TestOption configures a TestContext created with NewTestContext.
+type TestOption func(*TestContext)
+
+// Unordered makes every expectation of the TestContext match commands in any
+// order, as if they were all registered within a single ctx.InAnyOrder(...).
+func Unordered() TestOption {
+	return func(ctx *TestContext) {
+		ctx.unordered = true
+	}
+}
+
+// PanicOnFailure makes the TestContext panic with the failure message instead
+// of failing the test, so that negative tests can recover the message.
+// Finished is then only checked when it is called explicitly.
+func PanicOnFailure() TestOption {
+	return func(ctx *TestContext) {
+		ctx.panics = true
+	}
+}
+
+// Fallback makes the commands that match no expectation pass through to
+// interpreter, through InterpretSafely, instead of failing the test.  Commands
+// of a type that a pending expectation is waiting for still fail the test, so
+// that a mismatched or out of order command is not hidden by the fallback.
+// Commands issued by Callable commands that pass through are run by the
+// fallback context, not the TestContext.
+func Fallback(interpreter func(Context, interface{}) error) TestOption {
+	return func(ctx *TestContext) {
+		ctx.fallback = interpreter
+	}
+}
+
+// RunCallables makes the TestContext run Callable commands that match no
+// expectation by calling their Do method with the TestContext itself, as a
+// RealContext does, so that tests set expectations on the commands they
+// issue.  Callable commands of a type that a pending expectation is waiting
+// for still fail the test.  Sequence and Parallel issue their commands with DoSeries and
+// DoConcurrent, so combine it with ExpandBatches() to expect each of them
+// separately.
+func RunCallables() TestOption {
+	return func(ctx *TestContext) {
+		ctx.runCallables = true
+	}
+}
+
+// TestLogEntry records a command processed by a TestContext.
+type TestLogEntry struct {
+	Cmd interface{}
+	// Expectation is the expectation that stubbed the command, or nil if it
+	// passed through to the fallback interpreter or was a Callable run by
+	// the TestContext.
+	Expectation *Expectation
+	Err         error
+}
+
+// Stubbed reports whether the command was processed against an expectation.
+func (e TestLogEntry) Stubbed() bool {
+	return e.Expectation != nil
+}
+
+// ExpandBatches makes DoSeries and DoConcurrent process each of their
+// commands against its own expectation, registered with ctx.Cmd(...) as for
+// commands passed to Do, instead of passing the whole slice to one
+// expectation.  The commands of a DoConcurrent call may match the
+// expectations they are processed against in any order.  DoRace and DoQuorum
+// are not expanded.
+func ExpandBatches() TestOption {
+	return func(ctx *TestContext) {
+		ctx.expandBatches = true
+	}
+}
+
+// Expectation is a command expected by a TestContext, registered with
+// ctx.Cmd(...), ctx.Expect(...) and friends.
+type Expectation struct {
+	name     string
+	fn       interface{}
+	cmdType  reflect.Type
+	matchers []Matcher
+	handle   func(interface{}) (interface{}, error)
+	fields   []stubField
+	err      error
+	location string
+	group    int
+	calls    int
+
+	// min and max bound the number of commands processed against the
+	// expectation.  A negative max means there is no limit.
+	min, max       int
+	minSet, maxSet bool
+}
+
+// stubField is a field set on the command by Returns(...) or SetFields(...).
+type stubField struct {
+	name  string
+	value reflect.Value
+}
+
+// Returns copies the populated fields of result, a value of the command's
+// type or of the type it points to, into the command processed against the
+// expectation.
+func (e *Expectation) Returns(result interface{}) *Expectation {
+	t := reflect.TypeOf(result)
+	if e.cmdType != nil && t != e.cmdType && (e.cmdType.Kind() != reflect.Ptr || t != e.cmdType.Elem()) {
+		panic(fmt.Sprintf("%s.Returns(...) must receive a `%v`, but received a `%v`", e.name, e.cmdType, t))
+	}
+	return e.SetFields(result)
+}
+
+// SetFields sets fields of the command processed against the expectation.
+// fields is either a map from field names to values or a struct, or pointer
+// to a struct, whose populated fields are copied by name.
+func (e *Expectation) SetFields(fields interface{}) *Expectation {
+	v := indirect(reflect.ValueOf(fields))
+
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		for _, key := range keys {
+			value := v.MapIndex(key)
+			if value.Kind() == reflect.Interface {
+				value = value.Elem()
+			}
+			e.setField(key.String(), value)
+		}
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" || v.Field(i).IsZero() {
+				continue
+			}
+			e.setField(field.Name, v.Field(i))
+		}
+	default:
+		panic(fmt.Sprintf("%s.SetFields(...) must receive a map of field names to values or a struct, but received a `%v`", e.name, reflect.TypeOf(fields)))
+	}
+	return e
+}
+
+func (e *Expectation) setField(name string, value reflect.Value) {
+	if e.cmdType != nil {
+		err := checkField(e.cmdType, name, value)
+		if err != "" {
+			panic(fmt.Sprintf("%s cannot set %s", e.name, err))
+		}
+	}
+	e.fields = append(e.fields, stubField{name: name, value: value})
+}
+
+// Fails makes the expectation return err for the command processed against
+// it, after any fields are set.
+func (e *Expectation) Fails(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+// checkField describes why value cannot be assigned to the field name of
+// commands of type t, or returns an empty string if it can.
+func checkField(t reflect.Type, name string, value reflect.Value) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return fmt.Sprintf("field %s of a `%v`", name, t)
+	}
+
+	field, ok := t.FieldByName(name)
+	if !ok || field.PkgPath != "" {
+		return fmt.Sprintf("%s: %v has no such exported field", name, t)
+	}
+	if !value.IsValid() {
+		return ""
+	}
+	if !value.Type().AssignableTo(field.Type) && !convertible(value.Type(), field.Type) {
+		return fmt.Sprintf("%s: a `%v` cannot be assigned to a field of type `%v`", name, value.Type(), field.Type)
+	}
+	return ""
+}
+
+// convertible reports whether stub values of type from may be converted to
+// to, e.g. an int to an int64.  Conversions between kinds, such as an int to a
+// string, are not allowed.
+func convertible(from, to reflect.Type) bool {
+	if !from.ConvertibleTo(to) {
+		return false
+	}
+	return from.Kind() == to.Kind() || numeric(from) && numeric(to)
+}
+
+func numeric(t reflect.Type) bool {
+	return t.Kind() >= reflect.Int && t.Kind() <= reflect.Float64
+}
+
+// cmdFuncError is a panic raised by the harness when the function of an
+// expectation is invalid.  TestContext.run reports it as a failure.
+type cmdFuncError string
+
+// run processes cmd against the expectation.
+func (e *Expectation) run(cmd interface{}) (interface{}, error) {
+	result, err := e.handle(cmd)
+	if err != nil {
+		return result, err
+	}
+
+	if len(e.fields) > 0 {
+		v := indirect(reflect.ValueOf(cmd))
+		for _, f := range e.fields {
+			if msg := checkField(reflect.TypeOf(cmd), f.name, f.value); msg != "" {
+				panic(cmdFuncError(fmt.Sprintf("%s cannot set %s", e.name, msg)))
+			}
+
+			field := v.FieldByName(f.name)
+			if !f.value.IsValid() {
+				field.Set(reflect.Zero(field.Type()))
+			} else if f.value.Type().AssignableTo(field.Type()) {
+				field.Set(f.value)
+			} else {
+				field.Set(f.value.Convert(field.Type()))
+			}
+		}
+	}
+
+	return result, e.err
+}
+
+// When restricts the expectation to commands for which match, a function
+// taking the expectation's command type and returning a bool, returns true.
+func (e *Expectation) When(match interface{}) *Expectation {
+	value := reflect.ValueOf(match)
+	if value.Kind() != reflect.Func ||
+		value.Type().NumIn() != 1 ||
+		value.Type().In(0) != e.cmdType ||
+		value.Type().NumOut() != 1 ||
+		value.Type().Out(0).Kind() != reflect.Bool {
+		panic(fmt.Sprintf("%s.When(...) must receive a function that takes a `%v` and returns a bool.  In your test, you're passing in a value of type `%v`", e.name, e.cmdType, reflect.TypeOf(match)))
+	}
+	e.matchers = append(e.matchers, Match(match))
+	return e
+}
+
+// funcArg returns the type of the command fn takes, or nil if fn is not a
+// valid function.  Invalid functions are reported when they are called.
+func funcArg(fn interface{}) reflect.Type {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func || t.NumIn() != 1 {
+		return nil
+	}
+	return t.In(0)
+}
+
+// Times expects the command exactly n times.
+func (e *Expectation) Times(n int) *Expectation {
+	e.min, e.max = n, n
+	e.minSet, e.maxSet = true, true
+	return e
+}
+
+// AtLeast expects the command n times or more.  Combined with AtMost(...),
+// it sets the lower bound of a range.  It panics if n is above the upper
+// bound already set.
+func (e *Expectation) AtLeast(n int) *Expectation {
+	if e.maxSet && e.max >= 0 && e.max < n {
+		panic(fmt.Sprintf("%s.AtLeast(%d) contradicts the upper bound of %d already set", e.name, n, e.max))
+	}
+	e.min = n
+	e.minSet = true
+	if !e.maxSet {
+		e.max = -1
+	}
+	return e
+}
+
+// AtMost expects the command up to n times, including not at all.  Combined
+// with AtLeast(...), it sets the upper bound of a range.  It panics if n is
+// below the lower bound already set.
+func (e *Expectation) AtMost(n int) *Expectation {
+	if e.minSet && e.min > n {
+		panic(fmt.Sprintf("%s.AtMost(%d) contradicts the lower bound of %d already set", e.name, n, e.min))
+	}
+	e.max = n
+	e.maxSet = true
+	if !e.minSet {
+		e.min = 0
+	}
+	return e
+}
+
+// AnyTimes allows the command any number of times, including not at all.
+func (e *Expectation) AnyTimes() *Expectation {
+	e.min, e.max = 0, -1
+	e.minSet, e.maxSet = true, true
+	return e
+}
+
+// available reports whether more commands may be processed against the
+// expectation.
+func (e *Expectation) available() bool {
+	return e.max < 0 || e.calls < e.max
+}
+
+// satisfied reports whether enough commands were processed against the
+// expectation.
+func (e *Expectation) satisfied() bool {
+	return e.calls >= e.min
+}
+
+// repetition describes how many times the expectation was processed if it
+// was not expected exactly once.
+func (e *Expectation) repetition() string {
+	var expected string
+	switch {
+	case e.min == 1 && e.max == 1:
+		return ""
+	case e.min == e.max:
+		expected = fmt.Sprintf("%d times", e.min)
+	case e.max < 0 && e.min == 0:
+		expected = "any number of times"
+	case e.max < 0:
+		expected = fmt.Sprintf("at least %d times", e.min)
+	case e.min == 0:
+		expected = fmt.Sprintf("at most %d times", e.max)
+	default:
+		expected = fmt.Sprintf("between %d and %d times", e.min, e.max)
+	}
+	return fmt.Sprintf(" (expected %s, processed %d)", expected, e.calls)
+}
+
+func (e *Expectation) matches(cmd interface{}) bool {
+	// An invalid function matches nothing
+	if e.fn != nil && e.cmdType == nil {
+		return false
+	}
+	if e.cmdType != nil && e.cmdType != reflect.TypeOf(cmd) {
+		return false
+	}
+	for _, m := range e.matchers {
+		if !m.Matches(cmd) {
+			return false
+		}
+	}
+	return true
+}
+
+// verify lists why cmd, which is processed against the expectation, does not
+// match it.
+func (e *Expectation) verify(cmd interface{}) []string {
+	actualType := reflect.TypeOf(cmd)
+
+	// Functions report commands of the wrong type themselves
+	if e.fn != nil && actualType != e.cmdType {
+		return nil
+	}
+	if e.cmdType != nil && actualType != e.cmdType {
+		return []string{fmt.Sprintf("expected a command of type %v, got %v", e.cmdType, actualType)}
+	}
+
+	var lines []string
+	for _, m := range e.matchers {
+		if !m.Matches(cmd) {
+			lines = append(lines, explain(m, cmd)...)
+		}
+	}
+	return lines
+}
+
+// describe returns the expectation prefixed with the location it was
+// registered at.
+func (e *Expectation) describe() string {
+	return e.location + ": " + e.String()
+}
+
+func (e *Expectation) String() string {
+	if e.fn == nil {
+		return e.name
+	}
+	if e.cmdType == nil {
+		return fmt.Sprintf("%s with a `%v`", e.name, reflect.TypeOf(e.fn))
+	}
+	return fmt.Sprintf("%s expecting a %v", e.name, e.cmdType)
+}
+
+// InAnyOrder registers the expectations added by register as a group whose
+// commands may be processed in any order.  Each command is matched against
+// the first unprocessed expectation of the group whose command type and
+// matchers fit.  Groups and other expectations are still processed in the
+// order they were registered.
+func (ctx *TestContext) InAnyOrder(register func()) {
+	ctx.mu.Lock()
+	ctx.groups++
+	ctx.anyOrder = true
+	ctx.mu.Unlock()
+
+	defer func() {
+		ctx.mu.Lock()
+		ctx.anyOrder = false
+		ctx.mu.Unlock()
+	}()
+	register()
+}
+
+func (ctx *TestContext) expect(e *Expectation) *Expectation {
+	// Skip expect and the registration method to find the test's line
+	_, file, line, ok := runtime.Caller(2)
+	if ok {
+		e.location = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if !ctx.anyOrder && !ctx.unordered {
+		ctx.groups++
+	}
+	e.group = ctx.groups
+	if ctx.unordered {
+		e.group = 0
+	}
+	ctx.CmdQueue = append(ctx.CmdQueue, e)
+	return e
+}
+
+// next returns the expectation that cmd should be processed against.  The
+// candidates are the available expectations of the first group that is not
+// yet satisfied, along with those of any satisfied groups before it, which
+// may be skipped.  If no candidate fits, next returns nil along with a
+// description of the mismatch, which is empty when every candidate is
+// satisfied.
+func (ctx *TestContext) next(cmd interface{}) (*Expectation, string) {
+	var candidates []*Expectation
+	unsatisfied := false
+	for i, e := range ctx.CmdQueue {
+		if i > 0 && e.group != ctx.CmdQueue[i-1].group && unsatisfied {
+			break
+		}
+		if e.available() {
+			candidates = append(candidates, e)
+		}
+		if !e.satisfied() {
+			unsatisfied = true
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, ""
+	}
+
+	// A lone expectation is processed regardless of its type so that a
+	// mismatch is reported by the expectation itself, unless unmatched
+	// commands of other types pass through to the fallback interpreter or
+	// are run
+	_, callable := cmd.(Callable)
+	handled := ctx.fallback != nil || callable && ctx.runCallables
+	if len(candidates) == 1 && !candidates[0].satisfied() && !ctx.unordered && !(handled && candidates[0].cmdType != reflect.TypeOf(cmd)) {
+		return candidates[0], ""
+	}
+
+	for _, e := range candidates {
+		if e.matches(cmd) {
+			return e, ""
+		}
+	}
+
+	if !unsatisfied {
+		return nil, ""
+	}
+
+	// The candidates may only be processed in any order when the group that
+	// holds the next expectation has several of them; satisfied expectations
+	// before it may merely be skipped
+	last := candidates[len(candidates)-1]
+	anyOrder := ctx.unordered
+	for _, e := range candidates[:len(candidates)-1] {
+		if e.group == last.group {
+			anyOrder = true
+		}
 	}
-	err := ctx.CmdQueue[ctx.CmdIndex](cmd)
+	return nil, ctx.mismatch(cmd, candidates, anyOrder)
+}
+
+// window returns the pending expectations that the n commands of a
+// DoConcurrent call may be processed against: the next n that are not yet
+// satisfied, along with the satisfied ones that may be skipped before them
+// and the rest of the group of the last one.
+func (ctx *TestContext) window(n int) []*Expectation {
+	var window []*Expectation
+	unsatisfied := 0
+	for _, e := range ctx.CmdQueue {
+		if !e.available() {
+			continue
+		}
+		if unsatisfied >= n && (len(window) == 0 || e.group != window[len(window)-1].group) {
+			break
+		}
+		window = append(window, e)
+		if !e.satisfied() {
+			unsatisfied++
+		}
+	}
+	return window
+}
+
+// mismatch describes cmd not matching any of candidates, which may be
+// processed in any order if anyOrder is true.
+func (ctx *TestContext) mismatch(cmd interface{}, candidates []*Expectation, anyOrder bool) string {
+	expectations := "the next expectations that may be processed"
+	if anyOrder {
+		expectations = "the expectations that may be processed in any order"
+	}
+	msg := fmt.Sprintf("command number %d in your function does not match any of %s:\n%s\nThe remaining expectations are:", ctx.CmdIndex+1, expectations, litter.Sdump(cmd))
+	for _, e := range candidates {
+		msg += "\n  " + e.describe()
+	}
+	return msg
+}
+
+// claim selects the expectation that cmd is processed against from
+// candidates, or from the next pending expectations if candidates is nil, and
+// consumes it.  It also returns the number of the command in the function
+// under test and, if no expectation fits, a description of the mismatch.
+func (ctx *TestContext) claim(cmd interface{}, candidates []*Expectation) (*Expectation, int, string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	var e *Expectation
+	var mismatch string
+	if candidates == nil {
+		e, mismatch = ctx.next(cmd)
+	} else {
+		for _, candidate := range candidates {
+			if candidate.available() && candidate.matches(cmd) {
+				e = candidate
+				break
+			}
+		}
+		if e == nil {
+			mismatch = ctx.mismatch(cmd, candidates, true)
+		}
+	}
+
+	if e == nil {
+		return nil, ctx.CmdIndex + 1, mismatch
+	}
+	e.calls++
 	ctx.CmdIndex++
+
+	// Once a later group is reached, the skipped expectations of earlier
+	// groups can no longer be processed
+	for _, earlier := range ctx.CmdQueue {
+		if candidates != nil || earlier.group >= e.group {
+			break
+		}
+		earlier.max = earlier.calls
+	}
+	return e, ctx.CmdIndex, ""
+}
+
+func (ctx *TestContext) Do(cmd interface{}) error {
+	_, err := ctx.do(cmd, func(realCtx RealContext) (interface{}, error) {
+		return nil, InterpretSafely(realCtx, cmd)
+	})
 	return err
 }
 
+// do processes cmd against the next expectation and returns the result
+// scripted by the expectation along with its error.  If there is none and
+// the TestContext has a fallback interpreter, pass processes cmd instead.
+func (ctx *TestContext) do(cmd interface{}, pass func(RealContext) (interface{}, error)) (interface{}, error) {
+	e, number, mismatch := ctx.claim(cmd, nil)
+	if callable, ok := cmd.(Callable); ok && e == nil && ctx.runs(cmd) {
+		err := callable.Do(ctx)
+		ctx.record(cmd, nil, err)
+		return nil, err
+	}
+	if e == nil && ctx.passes(cmd) {
+		result, err := pass(ctx.fallbackContext())
+		ctx.record(cmd, nil, err)
+		return result, err
+	}
+	if mismatch != "" {
+		return nil, ctx.fail(mismatch)
+	}
+	if e == nil {
+		return nil, ctx.fail(fmt.Sprintf("attempting to process a command (number %d in your function) not specified in your test.  You'll need to add another ctx.Cmd(...) to your test to account for this command:\n%s", number, litter.Sdump(cmd)))
+	}
+	if lines := e.verify(cmd); len(lines) > 0 {
+		return nil, ctx.fail(unmatched(number, e, cmd, lines))
+	}
+
+	result, err := ctx.run(e, cmd)
+	ctx.record(cmd, e, err)
+	return result, err
+}
+
+// doBatch is like do for a slice of commands passed to one expectation.
+func (ctx *TestContext) doBatch(cmds interface{}, pass func(RealContext) (interface{}, error)) (interface{}, error) {
+	e, number, mismatch := ctx.claim(cmds, nil)
+	if e == nil && ctx.passes(cmds) {
+		result, err := pass(ctx.fallbackContext())
+		ctx.record(cmds, nil, err)
+		return result, err
+	}
+	if mismatch != "" {
+		return nil, ctx.fail(mismatch)
+	}
+	if e == nil {
+		return nil, ctx.fail(fmt.Sprintf("attempting to process a command (%d) not specified in test:\n%s", number, litter.Sdump(cmds)))
+	}
+	if lines := e.verify(cmds); len(lines) > 0 {
+		return nil, ctx.fail(unmatched(number, e, cmds, lines))
+	}
+
+	result, err := ctx.run(e, cmds)
+	ctx.record(cmds, e, err)
+	return result, err
+}
+
+// passes reports whether cmd, which matched no expectation, passes through to
+// the fallback interpreter.  It does not if a pending expectation is waiting
+// for a command of its type.
+func (ctx *TestContext) passes(cmd interface{}) bool {
+	return ctx.fallback != nil && !ctx.pending(cmd)
+}
+
+// runs reports whether cmd, a Callable command that matched no expectation, is
+// run by the TestContext.  Like passes, it does not if a pending expectation
+// is waiting for a command of its type.
+func (ctx *TestContext) runs(cmd interface{}) bool {
+	return ctx.runCallables && !ctx.pending(cmd)
+}
+
+// pending reports whether an expectation that is not yet satisfied is waiting
+// for a command of cmd's type.
+func (ctx *TestContext) pending(cmd interface{}) bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	for _, e := range ctx.CmdQueue {
+		if e.available() && !e.satisfied() && e.cmdType == reflect.TypeOf(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ctx *TestContext) fallbackContext() RealContext {
+	return RealContext{
+		Context:     ctx.Context,
+		Interpreter: ctx.fallback,
+	}
+}
+
+func (ctx *TestContext) record(cmd interface{}, e *Expectation, err error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.log = append(ctx.log, TestLogEntry{
+		Cmd:         cmd,
+		Expectation: e,
+		Err:         err,
+	})
+}
+
+// Log returns the commands processed so far, in the order they finished.
+func (ctx *TestContext) Log() []TestLogEntry {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return append([]TestLogEntry{}, ctx.log...)
+}
+
+// fail reports a failure of the test.  Unless the TestContext was created
+// with PanicOnFailure(), it marks the test as failed and returns
+// ErrTestFailure, which stops the function under test like any other error
+// returned by a command.
+func (ctx *TestContext) fail(msg string) error {
+	ctx.mu.Lock()
+	ctx.ShouldAbort = true
+	if ctx.FnErr == nil {
+		ctx.FnErr = ErrTestFailure
+	}
+	ctx.mu.Unlock()
+
+	if ctx.panics {
+		panic(msg)
+	}
+	ctx.T.Errorf("%s", msg)
+	return ErrTestFailure
+}
+
+// run processes cmd against e and reports invalid expectation functions as
+// failures.
+func (ctx *TestContext) run(e *Expectation, cmd interface{}) (result interface{}, err error) {
+	defer func() {
+		r := recover()
+		if msg, ok := r.(cmdFuncError); ok {
+			result, err = nil, ctx.fail(fmt.Sprintf("%s\nThe expectation is %s\nThe command was:\n%s", msg, e.describe(), litter.Sdump(cmd)))
+			return
+		}
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	return e.run(cmd)
+}
+
+func unmatched(number int, e *Expectation, cmd interface{}, lines []string) string {
+	return fmt.Sprintf("command number %d in your function does not match %s:\n  %s\nThe command was:\n%s", number, e.describe(), strings.Join(lines, "\n  "), litter.Sdump(cmd))
+}
+
 func (ctx *TestContext) DoSeries(cmds interface{}) error {
-	if ctx.CmdIndex >= len(ctx.CmdQueue) {
-		panic(fmt.Sprintf("attempting to process a command (%d) not specified in test", ctx.CmdIndex+1))
+	if !ctx.expandBatches {
+		_, err := ctx.doBatch(cmds, func(realCtx RealContext) (interface{}, error) {
+			return nil, realCtx.DoSeries(cmds)
+		})
+		return err
 	}
-	err := ctx.CmdQueue[ctx.CmdIndex](cmds)
-	ctx.CmdIndex++
-	return err
+
+	list, err := cmdList("DoSeries", cmds)
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range list {
+		err := ctx.Do(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (ctx *TestContext) DoConcurrent(cmds interface{}) error {
-	if ctx.CmdIndex >= len(ctx.CmdQueue) {
-		panic(fmt.Sprintf("attempting to process a command (%d) not specified in test", ctx.CmdIndex+1))
+	if !ctx.expandBatches {
+		_, err := ctx.doBatch(cmds, func(realCtx RealContext) (interface{}, error) {
+			return nil, realCtx.DoConcurrent(cmds)
+		})
+		return err
+	}
+
+	list, err := cmdList("DoConcurrent", cmds)
+	if err != nil {
+		return err
+	}
+
+	ctx.mu.Lock()
+	window := ctx.window(len(list))
+	ctx.mu.Unlock()
+
+	for _, cmd := range list {
+		e, _, mismatch := ctx.claim(cmd, window)
+		callable, isCallable := cmd.(Callable)
+		var cmdErr error
+		switch {
+		case e != nil:
+			_, cmdErr = ctx.run(e, cmd)
+			ctx.record(cmd, e, cmdErr)
+		case isCallable && ctx.runs(cmd):
+			cmdErr = callable.Do(ctx)
+			ctx.record(cmd, nil, cmdErr)
+		case ctx.passes(cmd):
+			cmdErr = InterpretSafely(ctx.fallbackContext(), cmd)
+			ctx.record(cmd, nil, cmdErr)
+		default:
+			return ctx.fail(mismatch)
+		}
+
+		if cmdErr != nil {
+			err = cmdErr
+		}
 	}
-	err := ctx.CmdQueue[ctx.CmdIndex](cmds)
-	ctx.CmdIndex++
 	return err
 }
 
+// DoAsync processes cmd against the next expectation straight away and
+// returns a Future that has already resolved.
+func (ctx *TestContext) DoAsync(cmd interface{}) Future {
+	return resolvedFuture(ctx.Do(cmd))
+}
+
+// DoStream processes cmd against the next expectation and returns a Stream
+// of the items scripted with ctx.Stream(...).  An error scripted along with
+// the items ends the Stream; any other error, including a failure of the
+// test, is returned instead.
+func (ctx *TestContext) DoStream(cmd interface{}) (Stream, error) {
+	result, err := ctx.do(cmd, func(realCtx RealContext) (interface{}, error) {
+		return realCtx.DoStream(cmd)
+	})
+	switch result := result.(type) {
+	case Stream:
+		return result, err
+	case []interface{}:
+		return staticStream(result, err), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return staticStream(nil, nil), nil
+}
+
+// DoRace passes cmds to the next expectation.  Expectations registered with
+// ctx.Race(...) choose the winner; otherwise the first command wins unless the
+// expectation returns an error.
+func (ctx *TestContext) DoRace(cmds interface{}) (int, error) {
+	list, err := cmdList("DoRace", cmds)
+	if err != nil {
+		return -1, err
+	}
+
+	if len(list) == 0 {
+		return -1, errors.New("at least one cmd must be passed to `DoRace`")
+	}
+
+	result, err := ctx.doBatch(cmds, func(realCtx RealContext) (interface{}, error) {
+		return realCtx.DoRace(cmds)
+	})
+	if err != nil {
+		return -1, err
+	}
+	index, _ := result.(int)
+	return index, nil
+}
+
+// DoQuorum passes cmds to the next expectation.  Expectations registered
+// with ctx.Quorum(...) decide the outcome of each command; otherwise every
+// command shares the error returned by the expectation.
+func (ctx *TestContext) DoQuorum(cmds interface{}, n int) ([]error, error) {
+	list, err := cmdList("DoQuorum", cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 1 || n > len(list) {
+		return nil, fmt.Errorf("a quorum of %d cannot be reached with %d cmds passed to `DoQuorum`", n, len(list))
+	}
+
+	result, err := ctx.doBatch(cmds, func(realCtx RealContext) (interface{}, error) {
+		return realCtx.DoQuorum(cmds, n)
+	})
+
+	outcomes, _ := result.([]error)
+	if outcomes == nil {
+		outcomes = make([]error, len(list))
+		for i := range outcomes {
+			outcomes[i] = err
+		}
+	}
+
+	succeeded := 0
+	for _, outcome := range outcomes {
+		if outcome == nil {
+			succeeded++
+		}
+	}
+
+	if succeeded < n {
+		return outcomes, QuorumError{
+			Needed:         n,
+			Succeeded:      succeeded,
+			AggregateError: AggregateError{Errors: failures(outcomes)},
+		}
+	}
+	return outcomes, nil
+}
+
+// Enqueue processes cmd against the next expectation, as if the job had
+// already run.
+func (ctx *TestContext) Enqueue(cmd interface{}, opts EnqueueOptions) error {
+	return ctx.Do(cmd)
+}
+
 func (ctx *TestContext) Deadline() (deadline time.Time, ok bool) {
 	return ctx.Context.Deadline()
 }
@@ -59,6 +927,8 @@ func (ctx *TestContext) Done() <-chan struct{} {
 }
 
 func (ctx *TestContext) Err() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
 	return ctx.FnErr
 }
 
@@ -66,67 +936,242 @@ func (ctx *TestContext) Value(key interface{}) interface{} {
 	return ctx.Context.Value(key)
 }
 
-func (ctx *TestContext) Cmd(fn interface{}) {
-	f := func(cmd interface{}) error {
-		value := reflect.ValueOf(fn)
-
-		// Verify that a function is passed in
-		if value.Kind() != reflect.Func {
-			panic(fmt.Sprintf("ctx.Cmd(...) must receive a function.  In your test, you're passing in a value of type `%v`", value.Type()))
-		}
-
-		// Verify that the function takes on 1 argument
-		if value.Type().NumIn() != 1 {
-			panic(fmt.Sprintf("ctx.Cmd(...) must receive a function that takes only 1 argument.  In your test, you're passing in a function that takes %d arguments", value.Type().NumIn()))
+// Expect registers an expectation for a command that matches all of
+// matchers.  Values that are not Matchers are compared with Eq, so
+//
+//	ctx.Expect(&Get{URL: "https://example.com"})
+//
+// expects a Get command equal to the one given.  A command that does not match
+// fails the test with the fields that differ.
+func (ctx *TestContext) Expect(matchers ...interface{}) *Expectation {
+	list := make([]Matcher, len(matchers))
+	var cmdType reflect.Type
+	for i, m := range matchers {
+		matcher, ok := m.(Matcher)
+		if !ok {
+			matcher = Eq(m)
 		}
+		list[i] = matcher
 
-		// Verify that the function's argument is a pointer or a slice of pointers
-		expectedType := value.Type().In(0)
-		actualType := reflect.TypeOf(cmd)
-
-		if expectedType.Kind() == reflect.Slice {
-			if expectedType.Elem().Kind() != reflect.Ptr {
-				panic("ctx.Cmd(...) must receive a function that takes a single argument of kind ptr (pointer) or a slice of pointers")
-			}
-		} else {
-			if expectedType.Kind() != reflect.Ptr {
-				panic("ctx.Cmd(...) must receive a function that takes a single argument of kind ptr (pointer) or a slice of pointers")
-			}
+		if typed, ok := matcher.(typedMatcher); ok && cmdType == nil {
+			cmdType = typed.cmdType()
 		}
+	}
 
-		// Verify that the function's argument type is the same as the type that comes from the non-test code
-		if expectedType != actualType {
-			panic(fmt.Sprintf("Your test expected a command of type %v, but the actual command was of type %v", expectedType, actualType))
-		}
+	return ctx.expect(&Expectation{
+		name:     fmt.Sprintf("ctx.Expect(%s)", matcherList(list)),
+		cmdType:  cmdType,
+		matchers: list,
+		min:      1,
+		max:      1,
+		handle: func(cmd interface{}) (interface{}, error) {
+			return nil, nil
+		},
+	})
+}
 
-		results := value.Call([]reflect.Value{reflect.ValueOf(cmd)})
+func (ctx *TestContext) Cmd(fn interface{}) *Expectation {
+	f := func(cmd interface{}) (interface{}, error) {
+		results := callCmdFunc("ctx.Cmd(...)", fn, cmd)
 
 		// If the function returns nothing, return nil
 		if len(results) == 0 {
-			return nil
+			return nil, nil
 		}
 
 		// Verify that the values returned from the function is an error
 		err, ok := results[0].Interface().(error)
 
 		if !ok {
-			panic(fmt.Sprintf("functions passed to ctx.Cmd(...) must return an error or return nothing.  In your test, the function is returning a value of type `%v`", results[0].Type()))
+			panic(cmdFuncError(fmt.Sprintf("functions passed to ctx.Cmd(...) must return an error or return nothing.  In your test, the function is returning a value of type `%v`", results[0].Type())))
 		}
 
-		return err
+		return nil, err
 	}
-	ctx.CmdQueue = append(ctx.CmdQueue, f)
+	return ctx.expect(&Expectation{
+		name:    "ctx.Cmd(...)",
+		fn:      fn,
+		cmdType: funcArg(fn),
+		min:     1,
+		max:     1,
+		handle:  f,
+	})
 }
 
-func (ctx *TestContext) Finished(t *testing.T) {
-	if ctx.CmdIndex != len(ctx.CmdQueue) {
-		t.Fatalf("expected %d cmds to be processed but processed %d", len(ctx.CmdQueue), ctx.CmdIndex)
+// Stream scripts the items emitted for a command passed to DoStream.  fn
+// takes the command and returns a slice of items, optionally followed by an
+// error that the stream ends with.
+func (ctx *TestContext) Stream(fn interface{}) *Expectation {
+	f := func(cmd interface{}) (interface{}, error) {
+		results := callCmdFunc("ctx.Stream(...)", fn, cmd)
+
+		// Verify that the function returns a slice of items and optionally an error
+		if len(results) == 0 || len(results) > 2 || results[0].Kind() != reflect.Slice {
+			panic(cmdFuncError("functions passed to ctx.Stream(...) must return a slice of items, optionally followed by an error"))
+		}
+
+		items := make([]interface{}, results[0].Len())
+		for i := range items {
+			items[i] = results[0].Index(i).Interface()
+		}
+		if len(results) == 1 {
+			return items, nil
+		}
+
+		if results[1].Type() != errorType {
+			panic(cmdFuncError(fmt.Sprintf("functions passed to ctx.Stream(...) must return an error as their second value.  In your test, the function is returning a value of type `%v`", results[1].Type())))
+		}
+
+		err, _ := results[1].Interface().(error)
+		return items, err
 	}
+	return ctx.expect(&Expectation{
+		name:    "ctx.Stream(...)",
+		fn:      fn,
+		cmdType: funcArg(fn),
+		min:     1,
+		max:     1,
+		handle:  f,
+	})
 }
 
-func NewTestContext(t *testing.T) *TestContext {
-	return &TestContext{
+// Race scripts the outcome of a DoRace call.  fn takes the slice of commands
+// and returns the index of the winning command and an error.
+func (ctx *TestContext) Race(fn interface{}) *Expectation {
+	f := func(cmds interface{}) (interface{}, error) {
+		results := callCmdFunc("ctx.Race(...)", fn, cmds)
+
+		// Verify that the function returns an index and an error
+		if len(results) != 2 || results[0].Kind() != reflect.Int || results[1].Type() != errorType {
+			panic(cmdFuncError("functions passed to ctx.Race(...) must return the index of the winning command and an error"))
+		}
+
+		err, _ := results[1].Interface().(error)
+		return int(results[0].Int()), err
+	}
+	return ctx.expect(&Expectation{
+		name:    "ctx.Race(...)",
+		fn:      fn,
+		cmdType: funcArg(fn),
+		min:     1,
+		max:     1,
+		handle:  f,
+	})
+}
+
+// Quorum scripts the outcome of a DoQuorum call.  fn takes the slice of
+// commands and returns the outcome of each command by index.
+func (ctx *TestContext) Quorum(fn interface{}) *Expectation {
+	f := func(cmds interface{}) (interface{}, error) {
+		results := callCmdFunc("ctx.Quorum(...)", fn, cmds)
+
+		// Verify that the function returns the outcomes
+		if len(results) != 1 || results[0].Type() != reflect.TypeOf([]error{}) {
+			panic(cmdFuncError("functions passed to ctx.Quorum(...) must return a slice of errors holding the outcome of each command"))
+		}
+
+		return results[0].Interface().([]error), nil
+	}
+	return ctx.expect(&Expectation{
+		name:    "ctx.Quorum(...)",
+		fn:      fn,
+		cmdType: funcArg(fn),
+		min:     1,
+		max:     1,
+		handle:  f,
+	})
+}
+
+// callCmdFunc verifies that fn is a function whose only argument has the type
+// of cmd and calls it.  name is the harness method fn was passed to.
+func callCmdFunc(name string, fn interface{}, cmd interface{}) []reflect.Value {
+	value := reflect.ValueOf(fn)
+
+	// Verify that a function is passed in
+	if value.Kind() != reflect.Func {
+		panic(cmdFuncError(fmt.Sprintf("%s must receive a function.  In your test, you're passing in a value of type `%v`", name, value.Type())))
+	}
+
+	// Verify that the function takes on 1 argument
+	if value.Type().NumIn() != 1 {
+		panic(cmdFuncError(fmt.Sprintf("%s must receive a function that takes only 1 argument.  In your test, you're passing in a function that takes %d arguments", name, value.Type().NumIn())))
+	}
+
+	// Verify that the function's argument is a pointer or a slice of pointers
+	expectedType := value.Type().In(0)
+	actualType := reflect.TypeOf(cmd)
+
+	if expectedType.Kind() == reflect.Slice {
+		if expectedType.Elem().Kind() != reflect.Ptr && expectedType.Elem().Kind() != reflect.Interface {
+			panic(cmdFuncError(fmt.Sprintf("%s must receive a function that takes a single argument of kind ptr (pointer) or a slice of pointers", name)))
+		}
+	} else {
+		if expectedType.Kind() != reflect.Ptr {
+			panic(cmdFuncError(fmt.Sprintf("%s must receive a function that takes a single argument of kind ptr (pointer) or a slice of pointers", name)))
+		}
+	}
+
+	// Verify that the function's argument type is the same as the type that comes from the non-test code
+	if expectedType != actualType {
+		panic(cmdFuncError(fmt.Sprintf("Your test expected a command of type %v, but the actual command was of type %v", expectedType, actualType)))
+	}
+
+	// Verify that a slice of interfaces only holds pointers
+	if expectedType.Kind() == reflect.Slice && expectedType.Elem().Kind() == reflect.Interface {
+		s := reflect.ValueOf(cmd)
+		for i := 0; i < s.Len(); i++ {
+			if s.Index(i).Elem().Kind() != reflect.Ptr {
+				panic(cmdFuncError(fmt.Sprintf("Your test expected a slice of cmd pointers, but the actual slice contains a `%v` at index %d", s.Index(i).Elem().Kind(), i)))
+			}
+		}
+	}
+
+	return value.Call([]reflect.Value{reflect.ValueOf(cmd)})
+}
+
+// Finished fails the test if expectations were not satisfied.  Unless the
+// TestContext panics on failures, it is called automatically when the test
+// ends if the test has not failed already.
+func (ctx *TestContext) Finished(t testing.TB) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.finished = true
+
+	expected := 0
+	var leftover []*Expectation
+	for _, e := range ctx.CmdQueue {
+		expected += e.min
+		if !e.satisfied() {
+			leftover = append(leftover, e)
+		}
+	}
+
+	if len(leftover) > 0 {
+		msg := fmt.Sprintf("expected %d cmds to be processed but processed %d.  The expectations that were not processed are:", expected, ctx.CmdIndex)
+		for _, e := range leftover {
+			msg += "\n  " + e.describe() + e.repetition()
+		}
+		t.Errorf("%s", msg)
+	}
+}
+
+func NewTestContext(t testing.TB, opts ...TestOption) *TestContext {
+	ctx := &TestContext{
 		Context: context.Background(),
 		T:       t,
 	}
+	for _, opt := range opts {
+		opt(ctx)
+	}
+
+	t.Cleanup(func() {
+		ctx.mu.Lock()
+		skip := ctx.finished || ctx.ShouldAbort || ctx.panics
+		ctx.mu.Unlock()
+
+		if !skip && !t.Failed() {
+			ctx.Finished(t)
+		}
+	})
+	return ctx
 }
@@ -0,0 +1,108 @@
+package effects
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Validator is implemented by commands that can check their own fields
+// before they are dispatched to the interpreter.
+type Validator interface {
+	Validate() error
+}
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s %s", e.Field, e.Message)
+}
+
+type ValidationError struct {
+	Cmd    interface{}
+	Fields []FieldError
+}
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("invalid command %T: %s", e.Cmd, strings.Join(msgs, "; "))
+}
+
+// Validate checks the `effects:"required"` struct tags on cmd and then calls
+// cmd.Validate() if cmd implements Validator.  A nil error means the command
+// may be dispatched.
+func Validate(cmd interface{}) error {
+	fields := validateTags(cmd)
+
+	validator, ok := cmd.(Validator)
+	if ok {
+		err := validator.Validate()
+		switch verr := err.(type) {
+		case nil:
+		case ValidationError:
+			fields = append(fields, verr.Fields...)
+		case *ValidationError:
+			// A nil *ValidationError returned as an error is not a failure
+			if verr != nil {
+				fields = append(fields, verr.Fields...)
+			}
+		case FieldError:
+			fields = append(fields, verr)
+		default:
+			fields = append(fields, FieldError{Message: err.Error()})
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return ValidationError{
+		Cmd:    cmd,
+		Fields: fields,
+	}
+}
+
+func validateTags(cmd interface{}) []FieldError {
+	value := reflect.ValueOf(cmd)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []FieldError
+	t := value.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("effects")
+		if !ok {
+			continue
+		}
+
+		for _, rule := range strings.Split(tag, ",") {
+			switch strings.TrimSpace(rule) {
+			case "required":
+				if value.Field(i).IsZero() {
+					fields = append(fields, FieldError{
+						Field:   field.Name,
+						Message: "is required",
+					})
+				}
+			}
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,124 @@
+package effects_test
+
+import (
+	"context"
+	"errors"
+	"github.com/orourkedd/effects"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type Fetch struct {
+	URL  string `effects:"required"`
+	ID   int    `effects:"required"`
+	Body string
+}
+
+type Lookup struct {
+	ID int
+}
+
+func (l *Lookup) Validate() error {
+	if l.ID <= 0 {
+		return effects.FieldError{Field: "ID", Message: "must be positive"}
+	}
+	return nil
+}
+
+type Ping struct {
+	Host string `effects:"required"`
+}
+
+func (p *Ping) Validate() error {
+	return errors.New("ping is disabled")
+}
+
+type Resolve struct {
+	Host *string
+}
+
+func (r *Resolve) Validate() error {
+	if *r.Host == "" {
+		return &effects.ValidationError{Cmd: r, Fields: []effects.FieldError{{Field: "Host", Message: "is empty"}}}
+	}
+	var err *effects.ValidationError
+	return err
+}
+
+func TestEffectsValidateRequiredTags(t *testing.T) {
+	called := false
+	ctx := effects.NewContext(context.Background(), func(ctx effects.Context, cmd interface{}) error {
+		called = true
+		return nil
+	})
+
+	err := ctx.Do(&Fetch{})
+	assert.False(t, called)
+	assert.Equal(t, "invalid command *effects_test.Fetch: URL is required; ID is required", err.Error())
+
+	verr, ok := err.(effects.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, []effects.FieldError{
+		{Field: "URL", Message: "is required"},
+		{Field: "ID", Message: "is required"},
+	}, verr.Fields)
+
+	err = ctx.Do(&Fetch{URL: "https://example.com", ID: 1})
+	assert.Nil(t, err)
+	assert.True(t, called)
+}
+
+func TestEffectsValidateMethod(t *testing.T) {
+	called := false
+	ctx := effects.NewContext(context.Background(), func(ctx effects.Context, cmd interface{}) error {
+		called = true
+		return nil
+	})
+
+	err := ctx.Do(&Lookup{})
+	assert.False(t, called)
+	assert.Equal(t, effects.ValidationError{
+		Cmd:    &Lookup{},
+		Fields: []effects.FieldError{{Field: "ID", Message: "must be positive"}},
+	}, err)
+
+	err = ctx.Do(&Lookup{ID: 1})
+	assert.Nil(t, err)
+	assert.True(t, called)
+}
+
+func TestEffectsValidateTagsAndMethod(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), interpreter)
+
+	err := ctx.Do(&Ping{})
+	assert.Equal(t, "invalid command *effects_test.Ping: Host is required; ping is disabled", err.Error())
+}
+
+func TestEffectsValidateSeries(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), func(ctx effects.Context, cmd interface{}) error {
+		return nil
+	})
+
+	err := ctx.DoSeries([]*Lookup{{ID: 1}, {ID: 0}})
+	assert.Equal(t, "invalid command *effects_test.Lookup: ID must be positive", err.Error())
+}
+
+func TestEffectsValidatePanics(t *testing.T) {
+	ctx := effects.NewContext(context.Background(), func(ctx effects.Context, cmd interface{}) error {
+		return nil
+	})
+
+	err := ctx.Do(&Resolve{})
+	assert.IsType(t, effects.InterpreterError{}, err)
+
+	err = ctx.DoConcurrent([]*Resolve{{}, {}})
+	assert.IsType(t, effects.InterpreterError{}, err)
+
+	empty := ""
+	err = ctx.Do(&Resolve{Host: &empty})
+	assert.Equal(t, "invalid command *effects_test.Resolve: Host is empty", err.Error())
+
+	// a nil *ValidationError is not a failure
+	host := "example.com"
+	assert.Nil(t, ctx.Do(&Resolve{Host: &host}))
+}